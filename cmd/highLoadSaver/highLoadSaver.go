@@ -2,6 +2,7 @@
 package main
 
 import (
+	"flag"
 	"os"
 	"os/signal"
 	"syscall"
@@ -10,27 +11,67 @@ import (
 	"github.com/vynovikov/highLoadSaver/internal/adapters/driven/saver"
 
 	"github.com/vynovikov/highLoadSaver/internal/adapters/driver/rpc"
+	"github.com/vynovikov/highLoadSaver/internal/config"
 	"github.com/vynovikov/highLoadSaver/internal/logger"
+	"github.com/vynovikov/highLoadSaver/internal/metrics"
 )
 
 // Tested in highLoadSaver_test.go
 func main() {
-	saver, err := saver.NewSaver("results")
+	resultsPath := flag.String("results", "", "folder to save submissions to, overrides SAVER_RESULTS_PATH")
+	flag.Parse()
+
+	cfg, err := config.Load()
 	if err != nil {
-		logger.L.Errorf("in main.main cannot create saver: %v\n", err)
+		logger.L.Fatalf("in main.main cannot load config: %v\n", err)
+	}
+	logger.L.SetLevel(cfg.LogLevel)
+	if len(*resultsPath) > 0 {
+		cfg.ResultsPath = *resultsPath
 	}
-	app, done := application.NewApp(saver)
-	receiver := rpc.NewReceiver(app)
+	if len(cfg.MetricsAddr) > 0 {
+		go func() {
+			err := metrics.Serve(cfg.MetricsAddr)
+			logger.L.Errorf("in main.main metrics server is stopped: %v\n", err)
+		}()
+	}
+	saver, err := saver.NewSaver(cfg)
+	if err != nil {
+		logger.L.Fatalf("in main.main cannot create saver: %v\n", err)
+	}
+	app, done := application.NewApp(saver, cfg)
+	receiver := rpc.NewReceiver(app, cfg)
 	go receiver.Run()
-	go SignalListen(app)
+	go SignalListen(app, make(chan os.Signal, 1))
 	<-done
+	if err := app.Err(); err != nil {
+		logger.L.Fatalf("in main.main highLoadSaver has failed: %v\n", err)
+	}
 	logger.L.Errorln("highLoadSaver is interrupted")
 }
 
-// SignalListen listens for Interrupt signal, when receiving one invokes stop function
-func SignalListen(app application.Application) {
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT)
-	<-sigChan
-	go app.Stop()
+// SignalListen listens for signals on sigChan.
+// Interrupt and termination signals stop application gracefully, hangup reloads configuration
+func SignalListen(app application.Application, sigChan chan os.Signal) {
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	for sig := range sigChan {
+
+		if sig == syscall.SIGHUP {
+
+			cfg, err := config.Load()
+			if err != nil {
+				logger.L.Errorf("in main.SignalListen cannot reload config, keeping current one: %v\n", err)
+
+				continue
+			}
+			logger.L.SetLevel(cfg.LogLevel)
+			app.Reload(cfg)
+
+			continue
+		}
+		logger.L.Infof("in main.SignalListen got %v, stopping\n", sig)
+
+		go app.Stop()
+	}
 }
@@ -1,9 +1,19 @@
 package main
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/segmentio/kafka-go"
+	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/suite"
+	"github.com/vynovikov/highLoadSaver/internal/config"
+	"github.com/vynovikov/highLoadSaver/internal/logger"
 )
 
 type mainSuite struct {
@@ -14,6 +24,103 @@ func TestMainSuite(t *testing.T) {
 	suite.Run(t, new(mainSuite))
 }
 
+type appMock struct {
+	reloaded []*config.Config
+	stopped  int
+	l        sync.Mutex
+}
+
+func (a *appMock) HandleKafkaMessage(kafka.Message) error { return nil }
+func (a *appMock) Committable(m kafka.Message) int64      { return m.Offset }
+func (a *appMock) GiveUp(kafka.Message)                   {}
+func (a *appMock) Resume(int) int64                       { return -1 }
+func (a *appMock) Context() context.Context               { return context.Background() }
+func (a *appMock) Drained()                               {}
+func (a *appMock) Fail(error)                             {}
+
+func (a *appMock) Reload(c *config.Config) {
+	a.l.Lock()
+	defer a.l.Unlock()
+
+	a.reloaded = append(a.reloaded, c)
+}
+
+func (a *appMock) Stop() {
+	a.l.Lock()
+	defer a.l.Unlock()
+
+	a.stopped++
+}
+
+func (s *mainSuite) TestSignalListen() {
+	defer logger.L.SetLevel(logger.L.GetLevel())
+
+	tt := []struct {
+		name        string
+		env         map[string]string
+		signals     []os.Signal
+		wantReloads int
+		wantStops   int
+		wantLevel   log.Level
+	}{
+		{
+			name:      "interrupt",
+			signals:   []os.Signal{syscall.SIGINT},
+			wantStops: 1,
+			wantLevel: log.InfoLevel,
+		},
+		{
+			name:      "termination",
+			signals:   []os.Signal{syscall.SIGTERM},
+			wantStops: 1,
+			wantLevel: log.InfoLevel,
+		},
+		{
+			name:        "hangup",
+			env:         map[string]string{"SAVER_LOG_LEVEL": "debug"},
+			signals:     []os.Signal{syscall.SIGHUP},
+			wantReloads: 1,
+			wantLevel:   log.DebugLevel,
+		},
+		{
+			name:      "hangup with bad config",
+			env:       map[string]string{"SAVER_LOG_LEVEL": "loud"},
+			signals:   []os.Signal{syscall.SIGHUP},
+			wantLevel: log.InfoLevel,
+		},
+		{
+			name:        "hangup then termination",
+			env:         map[string]string{"SAVER_LOG_LEVEL": "warn"},
+			signals:     []os.Signal{syscall.SIGHUP, syscall.SIGTERM},
+			wantReloads: 1,
+			wantStops:   1,
+			wantLevel:   log.WarnLevel,
+		},
+	}
+	for _, v := range tt {
+		s.Run(v.name, func() {
+			logger.L.SetLevel(log.InfoLevel)
+			s.T().Setenv("SAVER_LOG_LEVEL", v.env["SAVER_LOG_LEVEL"])
+			s.T().Setenv("KAFKA_TOPIC", "topic1")
+
+			app, sigChan := &appMock{}, make(chan os.Signal, 1)
+			go SignalListen(app, sigChan)
+			for _, sig := range v.signals {
+				sigChan <- sig
+			}
+			time.Sleep(time.Millisecond * 50)
+			signal.Stop(sigChan)
+
+			app.l.Lock()
+			defer app.l.Unlock()
+
+			s.Equal(v.wantReloads, len(app.reloaded))
+			s.Equal(v.wantStops, app.stopped)
+			s.Equal(v.wantLevel, logger.L.GetLevel())
+		})
+	}
+}
+
 /*
 func (s *mainSuite) TestWorkFlow() {
 	g, generatorChan := newGenerator()
@@ -3,10 +3,15 @@
 package application
 
 import (
+	"context"
+	"fmt"
+
 	"github.com/segmentio/kafka-go"
 	"github.com/vynovikov/highLoadSaver/internal/adapters/driven/saver"
 	"github.com/vynovikov/highLoadSaver/internal/adapters/driver/rpc/pb"
+	"github.com/vynovikov/highLoadSaver/internal/config"
 	"github.com/vynovikov/highLoadSaver/internal/logger"
+	"github.com/vynovikov/highLoadSaver/internal/repo"
 	"google.golang.org/protobuf/proto"
 
 	"sync"
@@ -15,42 +20,147 @@ import (
 
 type ApplicationStruct struct {
 	S        saver.Saver
+	C        *config.Config
 	stopping bool
-	timer    *time.Timer
+	timers   map[string]*timer // inactivity timers keyed by ts
+	ctx      context.Context   // cancelled when application starts stopping
+	cancel   context.CancelFunc
+	drained  chan struct{} // closed when receiver has handled its last message
+	drainer  sync.Once
 	done     chan struct{}
+	err      error // terminal failure application is stopped by, nil if it is stopped normally
 	l        sync.Mutex
 }
 
-func NewAppStoreOnly(s saver.Saver) *ApplicationStruct {
-	done := make(chan struct{})
+// timer is an inactivity timer of submission.
+// Its identity tells the current timer from the ones replaced by LastAction
+type timer struct {
+	t *time.Timer
+}
+
+func NewAppStoreOnly(s saver.Saver, c *config.Config) *ApplicationStruct {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &ApplicationStruct{
-		S:    s,
-		done: done,
+		S:       s,
+		C:       c,
+		timers:  make(map[string]*timer),
+		ctx:     ctx,
+		cancel:  cancel,
+		drained: make(chan struct{}),
+		done:    make(chan struct{}),
 	}
 }
 
-func NewApp(s saver.Saver) (*ApplicationStruct, chan struct{}) {
-	done := make(chan struct{})
-	return &ApplicationStruct{
-		S:    s,
-		done: done,
-	}, done
+// NewApp returns application and channel closed when it is stopped.
+// Submissions restored by saver get inactivity timers as if their last chunk has just come
+func NewApp(s saver.Saver, c *config.Config) (*ApplicationStruct, chan struct{}) {
+	a := NewAppStoreOnly(s, c)
+	for _, ts := range s.Pending() {
+		a.LastAction(ts)
+	}
+	return a, a.done
 }
 
 type Application interface {
 	HandleKafkaMessage(kafka.Message) error
+	Committable(kafka.Message) int64
+	Resume(int) int64
+	GiveUp(kafka.Message)
+	Context() context.Context
+	Drained()
+	Fail(error)
+	Reload(*config.Config)
 	Stop()
 }
 
+// MalformedError is returned for message which cannot be decoded or is invalid, so that trying it again is useless
+type MalformedError struct {
+	Err error
+}
+
+func (e *MalformedError) Error() string {
+	return e.Err.Error()
+}
+
+// HandleKafkaMessage decodes m into header and body and passes them to saver
 func (a *ApplicationStruct) HandleKafkaMessage(m kafka.Message) error {
-	unmarshalled := &pb.MessageHeader{}
+	header, body, err := Decode(m)
+	if err != nil {
+		return &MalformedError{Err: err}
+	}
+	logger.L.Infof("in application.HandleKafkaMessage header: %v, body len: %d, last: %t\n", header, len(body.Body), body.Last)
 
-	err := proto.Unmarshal(m.Value, unmarshalled)
+	err = a.S.Save(header, body, repo.Position{Partition: m.Partition, Offset: m.Offset})
 	if err != nil {
 		return err
 	}
-	logger.L.Infof("in application.HandleKafkaMessage unmarshalled: %v\n", unmarshalled)
-	return a.S.Save(unmarshalled)
+	if body.Last {
+		a.ClearStore(header.Ts)
+	} else {
+		a.LastAction(header.Ts)
+	}
+	return nil
+}
+
+// Committable returns offset up to which partition of handled message m may be committed, -1 if there is none
+func (a *ApplicationStruct) Committable(m kafka.Message) int64 {
+	return a.S.Committable(repo.Position{Partition: m.Partition, Offset: m.Offset})
+}
+
+// Resume returns offset partition is read from by reader without consumer group, -1 if none of its messages has been saved
+func (a *ApplicationStruct) Resume(partition int) int64 {
+	return a.S.Resume(partition)
+}
+
+// GiveUp abandons submission of message m which receiver has given up, so that it is not published with m missing.
+// Its chunks coming afterwards are rejected. Message of no known submission is only marked handled, as m is once its
+// submission is given up, so that it is not read again
+func (a *ApplicationStruct) GiveUp(m kafka.Message) {
+	header := &pb.MessageHeader{}
+	if proto.Unmarshal(m.Key, header) != nil || repo.CheckTS(header.Ts) != nil {
+		a.skip(m)
+		return
+	}
+	a.ClearStore(header.Ts)
+
+	a.l.Lock()
+	policy, retention := a.C.AbandonPolicy, a.C.AbandonedRetention
+	a.l.Unlock()
+
+	err := a.S.Reject(header.Ts, policy == config.PolicyDelete)
+	if err != nil {
+		logger.L.Errorf("in application.GiveUp unable to give up submission %q: %v\n", header.Ts, err)
+		return
+	}
+	logger.L.Warnf("in application.GiveUp submission %q lost message at partition %d offset %d and is given up, policy %q\n", header.Ts, m.Partition, m.Offset, policy)
+
+	a.skip(m)
+	a.purge(retention)
+}
+
+// skip marks message m given up handled, so that reader of explicit partition does not read it again after restart
+func (a *ApplicationStruct) skip(m kafka.Message) {
+	err := a.S.Skip(repo.Position{Partition: m.Partition, Offset: m.Offset})
+	if err != nil {
+		logger.L.Errorf("in application.skip unable to mark message at partition %d offset %d handled: %v\n", m.Partition, m.Offset, err)
+	}
+}
+
+// Decode unmarshals kafka message key into header and value into body.
+// Header without valid ts cannot be matched to any submission, so it is rejected
+func Decode(m kafka.Message) (*pb.MessageHeader, *pb.MessageBody, error) {
+	header, body := &pb.MessageHeader{}, &pb.MessageBody{}
+
+	if err := proto.Unmarshal(m.Key, header); err != nil {
+		return nil, nil, fmt.Errorf("in application.Decode unable to unmarshal header at partition %d offset %d: %v", m.Partition, m.Offset, err)
+	}
+	if err := proto.Unmarshal(m.Value, body); err != nil {
+		return nil, nil, fmt.Errorf("in application.Decode unable to unmarshal body at partition %d offset %d: %v", m.Partition, m.Offset, err)
+	}
+	if err := repo.CheckTS(header.Ts); err != nil {
+		return nil, nil, fmt.Errorf("in application.Decode header at partition %d offset %d has invalid ts: %v", m.Partition, m.Offset, err)
+	}
+	return header, body, nil
 }
 
 func (a *ApplicationStruct) FileClose() error {
@@ -61,19 +171,154 @@ func (a *ApplicationStruct) TableSave(ts string) error {
 	return nil
 }
 
+// LastAction restarts inactivity timer of submission ts
 func (a *ApplicationStruct) LastAction(ts string) {
+	a.l.Lock()
+	defer a.l.Unlock()
+
+	if t, ok := a.timers[ts]; ok {
+		t.t.Stop()
+		delete(a.timers, ts)
+	}
+	if a.C.SessionTimeout == 0 || a.stopping {
+		return
+	}
+	t := &timer{}
+	t.t = time.AfterFunc(a.C.SessionTimeout, func() { a.abandon(ts, t) })
+	a.timers[ts] = t
 }
 
+// ClearStore stops inactivity timer of completed submission ts
 func (a *ApplicationStruct) ClearStore(ts string) {
+	a.l.Lock()
+	defer a.l.Unlock()
+
+	if t, ok := a.timers[ts]; ok {
+		t.t.Stop()
+		delete(a.timers, ts)
+	}
+}
+
+// abandon gives up submission ts which got no chunks during session timeout.
+// Timer t that has already been replaced by LastAction does nothing
+func (a *ApplicationStruct) abandon(ts string, t *timer) {
+	a.l.Lock()
+	if a.timers[ts] != t {
+		a.l.Unlock()
+		return
+	}
+	delete(a.timers, ts)
+	timeout, policy, retention := a.C.SessionTimeout, a.C.AbandonPolicy, a.C.AbandonedRetention
+	a.l.Unlock()
+
+	err := a.S.Abandon(ts, policy == config.PolicyDelete)
+	if err != nil {
+		logger.L.Errorf("in application.abandon unable to abandon submission %q: %v\n", ts, err)
+		return
+	}
+	logger.L.Warnf("in application.abandon submission %q got no data for %v and is abandoned, policy %q\n", ts, timeout, policy)
+
+	a.purge(retention)
+}
+
+// purge removes abandoned submissions and forgets given up ones older than retention, zero retention keeps them
+func (a *ApplicationStruct) purge(retention time.Duration) {
+	if retention <= 0 {
+		return
+	}
+	err := a.S.Purge(retention)
+	if err != nil {
+		logger.L.Errorf("in application.purge unable to purge abandoned submissions: %v\n", err)
+	}
+}
+
+// Reload replaces configuration. Running inactivity timers keep their timeout,
+// new one applies from the next chunk of each submission
+func (a *ApplicationStruct) Reload(c *config.Config) {
+	a.l.Lock()
+	defer a.l.Unlock()
+
+	a.C = c
+	// only settings applied on reload are logged, others, e.g. credentials, stay out of logs
+	logger.L.Infof("in application.Reload configuration is reloaded: log level %v, session timeout %v, abandon policy %q, abandoned retention %v, shutdown timeout %v\n",
+		c.LogLevel, c.SessionTimeout, c.AbandonPolicy, c.AbandonedRetention, c.ShutdownTimeout)
+}
+
+// Context is cancelled when application starts stopping, receivers should stop fetching then
+func (a *ApplicationStruct) Context() context.Context {
+	return a.ctx
+}
+
+// Drained is called by receiver after its last message has been saved and committed
+func (a *ApplicationStruct) Drained() {
+	a.drainer.Do(func() { close(a.drained) })
+}
+
+// Fail stops application because of terminal failure err, e.g. receiver which cannot fetch anymore.
+// First failure is kept, it is returned by Err once application is stopped
+func (a *ApplicationStruct) Fail(err error) {
+	a.l.Lock()
+	if a.err == nil {
+		a.err = err
+	}
+	a.l.Unlock()
+
+	logger.L.Errorf("in application.Fail application is stopping because of failure: %v\n", err)
+
+	// caller may be receiver which has to return before it is drained
+	go a.Stop()
 }
 
+// Err returns failure application is stopped by, nil if it is stopped normally
+func (a *ApplicationStruct) Err() error {
+	a.l.Lock()
+	defer a.l.Unlock()
+
+	return a.err
+}
+
+// Stop drains application: receiver stops fetching and finishes in-flight message,
+// then saver flushes and closes files of unfinished submissions.
+// Done is signalled afterwards or when shutdown timeout expires, whichever comes first
 func (a *ApplicationStruct) Stop() {
-	/*
-	   a.stopping = true
-
-	   	if !a.St.Busy() {
-	   		close(a.done)
-	   	}
-	*/
-	close(a.done)
+	a.l.Lock()
+	if a.stopping {
+		a.l.Unlock()
+		return
+	}
+	a.stopping = true
+	for ts, t := range a.timers {
+		t.t.Stop()
+		delete(a.timers, ts)
+	}
+	timeout := a.C.ShutdownTimeout
+	a.l.Unlock()
+
+	defer close(a.done)
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	a.cancel()
+
+	select {
+	case <-a.drained:
+	case <-deadline.C:
+		logger.L.Errorf("in application.Stop receiver is not drained in %v, stopping anyway\n", timeout)
+		return
+	}
+
+	closed := make(chan error, 1)
+	go func() { closed <- a.S.Close() }()
+
+	select {
+	case err := <-closed:
+		if err != nil {
+			logger.L.Errorf("in application.Stop unable to close saver: %v\n", err)
+			return
+		}
+		logger.L.Infoln("in application.Stop drained gracefully")
+	case <-deadline.C:
+		logger.L.Errorf("in application.Stop saver is not closed in %v, stopping anyway\n", timeout)
+	}
 }
@@ -1,9 +1,17 @@
 package application
 
 import (
+	"errors"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/segmentio/kafka-go"
 	"github.com/stretchr/testify/suite"
+	"github.com/vynovikov/highLoadSaver/internal/adapters/driver/rpc/pb"
+	"github.com/vynovikov/highLoadSaver/internal/config"
+	"github.com/vynovikov/highLoadSaver/internal/repo"
+	"google.golang.org/protobuf/proto"
 )
 
 type applicationSuite struct {
@@ -13,3 +21,447 @@ type applicationSuite struct {
 func TestApplicationSuite(t *testing.T) {
 	suite.Run(t, new(applicationSuite))
 }
+
+type saverMock struct {
+	headers   []*pb.MessageHeader
+	bodies    []*pb.MessageBody
+	positions []repo.Position
+	abandoned map[string]bool // ts to remove flag
+	rejected  map[string]bool // ts to remove flag
+	purged    []time.Duration
+	skipped   []repo.Position
+	pending   []string
+	closed    bool
+	err       error
+	rejectErr error
+	l         sync.Mutex
+}
+
+func (s *saverMock) Abandon(ts string, remove bool) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if s.abandoned == nil {
+		s.abandoned = make(map[string]bool)
+	}
+	s.abandoned[ts] = remove
+	return nil
+}
+
+func (s *saverMock) Reject(ts string, remove bool) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if s.rejected == nil {
+		s.rejected = make(map[string]bool)
+	}
+	if s.rejectErr != nil {
+		return s.rejectErr
+	}
+	s.rejected[ts] = remove
+	return nil
+}
+
+func (s *saverMock) Purge(retention time.Duration) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	s.purged = append(s.purged, retention)
+	return nil
+}
+
+func (s *saverMock) Pending() []string {
+	return s.pending
+}
+
+func (s *saverMock) Committable(p repo.Position) int64 {
+	return p.Offset
+}
+
+func (s *saverMock) Resume(partition int) int64 {
+	return -1
+}
+
+func (s *saverMock) Skip(p repo.Position) error {
+	s.skipped = append(s.skipped, p)
+	return nil
+}
+
+func (s *saverMock) Close() error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	s.closed = true
+	return nil
+}
+
+func (s *saverMock) isClosed() bool {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	return s.closed
+}
+
+func (s *saverMock) getAbandoned() map[string]bool {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	return s.abandoned
+}
+
+func (s *saverMock) Save(h *pb.MessageHeader, b *pb.MessageBody, p repo.Position) error {
+	s.headers = append(s.headers, h)
+	s.bodies = append(s.bodies, b)
+	s.positions = append(s.positions, p)
+	return s.err
+}
+
+func marshal(m proto.Message) []byte {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func (s *applicationSuite) TestHandleKafkaMessage() {
+	tt := []struct {
+		name          string
+		m             kafka.Message
+		saverErr      error
+		wantHeaders   []*pb.MessageHeader
+		wantBodies    []*pb.MessageBody
+		wantPos       []repo.Position
+		wantErr       bool
+		wantMalformed bool
+	}{
+		{
+			name: "header and body",
+			m: kafka.Message{
+				Partition: 2,
+				Offset:    15,
+				Key:       marshal(&pb.MessageHeader{Ts: "001", FormName: "alice", FileName: "first.txt", First: true}),
+				Value:     marshal(&pb.MessageBody{Body: []byte("azaza"), Last: true}),
+			},
+			wantHeaders: []*pb.MessageHeader{
+				{Ts: "001", FormName: "alice", FileName: "first.txt", First: true},
+			},
+			wantBodies: []*pb.MessageBody{
+				{Body: []byte("azaza"), Last: true},
+			},
+			wantPos: []repo.Position{
+				{Partition: 2, Offset: 15},
+			},
+		},
+		{
+			name: "empty body",
+			m: kafka.Message{
+				Key: marshal(&pb.MessageHeader{Ts: "002", FormName: "bob"}),
+			},
+			wantHeaders: []*pb.MessageHeader{
+				{Ts: "002", FormName: "bob"},
+			},
+			wantBodies: []*pb.MessageBody{
+				{},
+			},
+			wantPos: []repo.Position{
+				{},
+			},
+		},
+		{
+			name: "malformed key",
+			m: kafka.Message{
+				Key:   []byte{0xff, 0xff},
+				Value: marshal(&pb.MessageBody{Body: []byte("azaza")}),
+			},
+			wantErr:       true,
+			wantMalformed: true,
+		},
+		{
+			name: "malformed value",
+			m: kafka.Message{
+				Key:   marshal(&pb.MessageHeader{Ts: "003", FormName: "alice"}),
+				Value: []byte{0xff, 0xff},
+			},
+			wantErr:       true,
+			wantMalformed: true,
+		},
+		{
+			name: "no ts",
+			m: kafka.Message{
+				Key: marshal(&pb.MessageHeader{FormName: "alice"}),
+			},
+			wantErr:       true,
+			wantMalformed: true,
+		},
+		{
+			name: "unsafe ts",
+			m: kafka.Message{
+				Key: marshal(&pb.MessageHeader{Ts: "../001", FormName: "alice"}),
+			},
+			wantErr:       true,
+			wantMalformed: true,
+		},
+		{
+			name: "saver error",
+			m: kafka.Message{
+				Key: marshal(&pb.MessageHeader{Ts: "004", FormName: "alice"}),
+			},
+			saverErr: errors.New("disk is full"),
+			wantHeaders: []*pb.MessageHeader{
+				{Ts: "004", FormName: "alice"},
+			},
+			wantBodies: []*pb.MessageBody{
+				{},
+			},
+			wantPos: []repo.Position{
+				{},
+			},
+			wantErr: true,
+		},
+	}
+	for _, v := range tt {
+		s.Run(v.name, func() {
+			sm := &saverMock{err: v.saverErr}
+			a, _ := NewApp(sm, &config.Config{})
+
+			err := a.HandleKafkaMessage(v.m)
+
+			if v.wantErr {
+				s.Error(err)
+			} else {
+				s.NoError(err)
+			}
+			var me *MalformedError
+			s.Equal(v.wantMalformed, errors.As(err, &me))
+			s.Equal(len(v.wantHeaders), len(sm.headers))
+			for i := range v.wantHeaders {
+				s.True(proto.Equal(v.wantHeaders[i], sm.headers[i]))
+				s.True(proto.Equal(v.wantBodies[i], sm.bodies[i]))
+				s.Equal(v.wantPos[i], sm.positions[i])
+			}
+		})
+	}
+}
+
+func (s *applicationSuite) TestGiveUp() {
+	tt := []struct {
+		name         string
+		m            kafka.Message
+		policy       string
+		retention    time.Duration
+		rejectErr    error
+		wantRejected map[string]bool
+		wantPurged   []time.Duration
+		wantSkipped  []repo.Position
+	}{
+		{
+			name:         "moved",
+			m:            kafka.Message{Key: marshal(&pb.MessageHeader{Ts: "001", FormName: "alice"}), Partition: 1, Offset: 5},
+			policy:       config.PolicyMove,
+			wantRejected: map[string]bool{"001": false},
+			wantSkipped:  []repo.Position{{Partition: 1, Offset: 5}},
+		},
+		{
+			name:         "purged",
+			m:            kafka.Message{Key: marshal(&pb.MessageHeader{Ts: "001", FormName: "alice"}), Partition: 1, Offset: 5},
+			policy:       config.PolicyMove,
+			retention:    time.Hour,
+			wantRejected: map[string]bool{"001": false},
+			wantPurged:   []time.Duration{time.Hour},
+			wantSkipped:  []repo.Position{{Partition: 1, Offset: 5}},
+		},
+		{
+			name:         "deleted",
+			m:            kafka.Message{Key: marshal(&pb.MessageHeader{Ts: "001", FormName: "alice"}), Partition: 1, Offset: 5},
+			policy:       config.PolicyDelete,
+			wantRejected: map[string]bool{"001": true},
+			wantSkipped:  []repo.Position{{Partition: 1, Offset: 5}},
+		},
+		{
+			name:         "rejecting failed",
+			m:            kafka.Message{Key: marshal(&pb.MessageHeader{Ts: "001", FormName: "alice"}), Partition: 1, Offset: 5},
+			policy:       config.PolicyMove,
+			rejectErr:    errors.New("disk is full"),
+			wantRejected: map[string]bool{},
+		},
+		{
+			name:        "malformed key",
+			m:           kafka.Message{Key: []byte{0xff, 0xff}, Partition: 1, Offset: 5},
+			policy:      config.PolicyMove,
+			wantSkipped: []repo.Position{{Partition: 1, Offset: 5}},
+		},
+		{
+			name:        "unsafe ts",
+			m:           kafka.Message{Key: marshal(&pb.MessageHeader{Ts: "../001", FormName: "alice"}), Partition: 1, Offset: 5},
+			policy:      config.PolicyMove,
+			wantSkipped: []repo.Position{{Partition: 1, Offset: 5}},
+		},
+	}
+	for _, v := range tt {
+		s.Run(v.name, func() {
+			sm := &saverMock{rejectErr: v.rejectErr}
+			a, _ := NewApp(sm, &config.Config{SessionTimeout: time.Hour, AbandonPolicy: v.policy, AbandonedRetention: v.retention})
+			a.LastAction("001")
+
+			a.GiveUp(v.m)
+
+			s.Equal(v.wantRejected, sm.rejected)
+			s.Equal(v.wantPurged, sm.purged)
+			s.Equal(v.wantSkipped, sm.skipped)
+			_, ok := a.timers["001"]
+			s.Equal(v.wantRejected == nil, ok)
+			a.ClearStore("001")
+		})
+	}
+}
+
+func (s *applicationSuite) TestInactivity() {
+	tt := []struct {
+		name          string
+		c             *config.Config
+		pending       []string
+		bodies        []*pb.MessageBody
+		wantAbandoned map[string]bool
+		wantPurged    []time.Duration
+	}{
+		{
+			name: "incomplete moved",
+			c: &config.Config{
+				SessionTimeout:     time.Millisecond * 20,
+				AbandonPolicy:      config.PolicyMove,
+				AbandonedRetention: time.Hour,
+			},
+			bodies: []*pb.MessageBody{
+				{Body: []byte("azaza")},
+				{Body: []byte("bzbzb")},
+			},
+			wantAbandoned: map[string]bool{"001": false},
+			wantPurged:    []time.Duration{time.Hour},
+		},
+		{
+			name: "incomplete deleted",
+			c: &config.Config{
+				SessionTimeout:     time.Millisecond * 20,
+				AbandonPolicy:      config.PolicyDelete,
+				AbandonedRetention: time.Hour,
+			},
+			bodies: []*pb.MessageBody{
+				{Body: []byte("azaza")},
+			},
+			wantAbandoned: map[string]bool{"001": true},
+			wantPurged:    []time.Duration{time.Hour},
+		},
+		{
+			name: "completed",
+			c: &config.Config{
+				SessionTimeout: time.Millisecond * 20,
+				AbandonPolicy:  config.PolicyMove,
+			},
+			bodies: []*pb.MessageBody{
+				{Body: []byte("azaza")},
+				{Body: []byte("bzbzb"), Last: true},
+			},
+		},
+		{
+			name: "restored",
+			c: &config.Config{
+				SessionTimeout: time.Millisecond * 20,
+				AbandonPolicy:  config.PolicyMove,
+			},
+			pending:       []string{"002"},
+			wantAbandoned: map[string]bool{"002": false},
+		},
+		{
+			name: "timeout disabled",
+			c: &config.Config{
+				AbandonPolicy: config.PolicyMove,
+			},
+			bodies: []*pb.MessageBody{
+				{Body: []byte("azaza")},
+			},
+		},
+	}
+	for _, v := range tt {
+		s.Run(v.name, func() {
+			sm := &saverMock{pending: v.pending}
+			a, _ := NewApp(sm, v.c)
+
+			for i, b := range v.bodies {
+				err := a.HandleKafkaMessage(kafka.Message{
+					Offset: int64(i),
+					Key:    marshal(&pb.MessageHeader{Ts: "001", FormName: "alice", FileName: "first.txt", First: i == 0}),
+					Value:  marshal(b),
+				})
+				s.NoError(err)
+			}
+			time.Sleep(time.Millisecond * 100)
+
+			s.Equal(v.wantAbandoned, sm.getAbandoned())
+			s.Equal(v.wantPurged, sm.purged)
+		})
+	}
+}
+
+func (s *applicationSuite) TestStop() {
+	tt := []struct {
+		name       string
+		drained    bool
+		failure    error
+		wantClosed bool
+	}{
+		{
+			name:       "drained",
+			drained:    true,
+			wantClosed: true,
+		},
+		{
+			name: "not drained",
+		},
+		{
+			name:       "failed",
+			drained:    true,
+			failure:    errors.New("reader is closed"),
+			wantClosed: true,
+		},
+	}
+	for _, v := range tt {
+		s.Run(v.name, func() {
+			sm := &saverMock{}
+			a, done := NewApp(sm, &config.Config{
+				SessionTimeout:  time.Millisecond * 20,
+				ShutdownTimeout: time.Millisecond * 50,
+			})
+			err := a.HandleKafkaMessage(kafka.Message{
+				Key:   marshal(&pb.MessageHeader{Ts: "001", FormName: "alice", FileName: "first.txt", First: true}),
+				Value: marshal(&pb.MessageBody{Body: []byte("azaza")}),
+			})
+			s.Require().NoError(err)
+
+			drained := v.drained
+			go func() {
+				<-a.Context().Done()
+				if drained {
+					a.Drained()
+				}
+			}()
+			if v.failure != nil {
+				a.Fail(v.failure)
+			} else {
+				go a.Stop()
+			}
+
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				s.Fail("application is not stopped")
+			}
+			time.Sleep(time.Millisecond * 50)
+
+			s.Equal(v.failure, a.Err())
+
+			s.Equal(v.wantClosed, sm.isClosed())
+			s.Empty(sm.getAbandoned())
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package saver
+
+import (
+	"time"
+
+	"github.com/vynovikov/highLoadSaver/internal/adapters/driven/storage"
+	"github.com/vynovikov/highLoadSaver/internal/config"
+	"github.com/vynovikov/highLoadSaver/internal/logger"
+	"github.com/vynovikov/highLoadSaver/internal/repo"
+)
+
+// moments at which data may be flushed to disk
+const (
+	atChunk = iota // chunk or journal record is written, file or folder is created
+	atClose        // file is closed, submission is published or moved
+)
+
+// durable reports whether data must be flushed to disk at moment under fsync policy
+func durable(fsync string, moment int) bool {
+	switch fsync {
+	case config.FsyncChunk:
+		return true
+	case config.FsyncClose, config.FsyncPeriodic:
+		return moment == atClose
+	}
+	return false
+}
+
+// flush flushes open files, journal and folder of dirty session to disk
+func (ss *session) flush() error {
+	if !ss.dirty {
+		return nil
+	}
+	FIs := make([]*repo.FileInfo, 0, len(ss.F)+1)
+	for _, FI := range ss.F {
+		FIs = append(FIs, FI)
+	}
+	if ss.J != nil {
+		FIs = append(FIs, ss.J)
+	}
+	for _, FI := range FIs {
+		// closed files have been flushed by handle cache already
+		f := ss.H.acquireOpen(FI)
+		if f == nil {
+			continue
+		}
+		err := storage.SyncFile(f)
+		ss.H.release(FI)
+		if err != nil {
+			return err
+		}
+	}
+	err := storage.SyncDir(ss.Path)
+	if err != nil {
+		return err
+	}
+	ss.dirty = false
+
+	return nil
+}
+
+// flushLoop flushes dirty sessions every interval until stop is closed.
+// It groups flushes of many chunks into one under periodic policy
+func (s *SaverStruct) flushLoop(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		s.l.Lock()
+		sessions := make([]*session, 0, len(s.S))
+		for _, ss := range s.S {
+			sessions = append(sessions, ss)
+		}
+		s.l.Unlock()
+
+		for _, ss := range sessions {
+			ss.l.Lock()
+			if !ss.done {
+				if err := ss.flush(); err != nil {
+					logger.L.Errorf("in saver.flushLoop unable to flush submission %q: %v\n", ss.Ts, err)
+				}
+			}
+			ss.l.Unlock()
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package saver
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/vynovikov/highLoadSaver/internal/adapters/driven/storage"
+	"github.com/vynovikov/highLoadSaver/internal/logger"
+	"github.com/vynovikov/highLoadSaver/internal/metrics"
+	"github.com/vynovikov/highLoadSaver/internal/repo"
+)
+
+// handleCache keeps at most max files open, closing least recently used ones.
+// Closed file is reopened by its path when it is needed again.
+// Files in use are pinned and never closed, so max may be exceeded while all of them are busy
+type handleCache struct {
+	max   int // zero means unlimited
+	fsync string
+	lru   *list.List // of *repo.FileInfo, most recently used at front
+	items map[*repo.FileInfo]*handle
+	l     sync.Mutex
+}
+
+type handle struct {
+	e    *list.Element
+	pins int
+}
+
+func newHandleCache(max int, fsync string) *handleCache {
+	return &handleCache{
+		max:   max,
+		fsync: fsync,
+		lru:   list.New(),
+		items: make(map[*repo.FileInfo]*handle),
+	}
+}
+
+// acquire returns open file of FI, reopening it with flag if it has been closed.
+// File stays open until release is called
+func (c *handleCache) acquire(FI *repo.FileInfo, flag int) (*os.File, error) {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if FI.F == nil {
+		f, err := os.OpenFile(FI.Path, flag, 0666)
+		if err != nil {
+			return nil, fmt.Errorf("in saver.acquire unable to reopen file %q: %v", FI.Path, err)
+		}
+		FI.F = f
+		metrics.HandleReopens.Add(1)
+	}
+	hd, ok := c.items[FI]
+	if !ok {
+		hd = &handle{e: c.lru.PushFront(FI)}
+		c.items[FI] = hd
+		metrics.OpenFiles.Add(1)
+	}
+	c.lru.MoveToFront(hd.e)
+	hd.pins++
+	c.evict()
+
+	return FI.F, nil
+}
+
+// acquireOpen returns file of FI if it is open, nil otherwise.
+// Returned file stays open until release is called
+func (c *handleCache) acquireOpen(FI *repo.FileInfo) *os.File {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	hd, ok := c.items[FI]
+	if !ok {
+		return nil
+	}
+	hd.pins++
+
+	return FI.F
+}
+
+func (c *handleCache) release(FI *repo.FileInfo) {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if hd, ok := c.items[FI]; ok {
+		hd.pins--
+	}
+	c.evict()
+}
+
+// remove closes file of FI and forgets it
+func (c *handleCache) remove(FI *repo.FileInfo) error {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	hd, ok := c.items[FI]
+	if !ok {
+		return nil
+	}
+	c.lru.Remove(hd.e)
+	delete(c.items, FI)
+	metrics.OpenFiles.Add(-1)
+
+	err := FI.F.Close()
+	FI.F = nil
+	if err != nil {
+		return fmt.Errorf("in saver.remove unable to close file %q: %v", FI.Path, err)
+	}
+	return nil
+}
+
+// evict closes least recently used files which are not pinned until at most max are open.
+// Closed files are flushed first if policy requires flushing on close
+func (c *handleCache) evict() {
+	if c.max == 0 {
+		return
+	}
+	for e := c.lru.Back(); e != nil && len(c.items) > c.max; {
+		FI, prev := e.Value.(*repo.FileInfo), e.Prev()
+		if c.items[FI].pins == 0 {
+			c.lru.Remove(e)
+			delete(c.items, FI)
+			metrics.OpenFiles.Add(-1)
+			metrics.HandleEvictions.Add(1)
+
+			if durable(c.fsync, atClose) && !durable(c.fsync, atChunk) {
+				if err := storage.SyncFile(FI.F); err != nil {
+					logger.L.Errorf("in saver.evict %v\n", err)
+				}
+			}
+			if err := FI.F.Close(); err != nil {
+				logger.L.Errorf("in saver.evict unable to close file %q: %v\n", FI.Path, err)
+			}
+			FI.F = nil
+		}
+		e = prev
+	}
+}
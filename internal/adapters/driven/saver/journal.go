@@ -0,0 +1,488 @@
+package saver
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	json "github.com/goccy/go-json"
+	"github.com/vynovikov/highLoadSaver/internal/adapters/driven/storage"
+	"github.com/vynovikov/highLoadSaver/internal/logger"
+	"github.com/vynovikov/highLoadSaver/internal/repo"
+)
+
+const (
+	// journalFolder keeps journals of submissions being assembled, one file per ts
+	journalFolder = ".journal"
+	// watermarksFile keeps offsets of last saved messages after their journals are gone.
+	// Ts never starts with dot, so it cannot clash with journals
+	watermarksFile = ".watermarks.json"
+	// replayFile keeps offsets up to watermarks whose streamed data was lost, keyed by partition
+	replayFile = ".replay.json"
+	// rejectedFile keeps ts of submissions given up
+	rejectedFile = ".rejected.json"
+)
+
+// journalFlag opens journal for appending
+const journalFlag = os.O_WRONLY | os.O_APPEND
+
+// record is journal entry describing message applied to submission
+type record struct {
+	Partition   int       `json:"partition"`
+	Offset      int64     `json:"offset"`
+	Time        time.Time `json:"time"`
+	FormName    string    `json:"formName,omitempty"`
+	Part        uint32    `json:"part,omitempty"`
+	Sent        *uint32   `json:"sent,omitempty"`        // part sent by parser, if value is renumbered
+	FileName    string    `json:"fileName,omitempty"`    // name sent by client, empty for text field
+	Stored      string    `json:"stored,omitempty"`      // name of file in submission folder
+	Size        int64     `json:"size,omitempty"`        // file size after message is applied
+	Text        []byte    `json:"text,omitempty"`        // chunk of text value kept in manifest
+	ChunkSHA256 string    `json:"chunkSha256,omitempty"` // hex encoded digest of file chunk
+	Quarantined bool      `json:"quarantined,omitempty"` // file is quarantined by this message or had been before
+	Rejected    bool      `json:"rejected,omitempty"`    // chunk does not match its digest, it is not applied
+	Last        bool      `json:"last,omitempty"`
+}
+
+func (s *SaverStruct) journalName(ts string) string {
+	return filepath.Join(s.Path, journalFolder, ts)
+}
+
+// openJournal opens journal of session for appending
+func (s *SaverStruct) openJournal(ss *session) error {
+	fileName := s.journalName(ss.Ts)
+
+	f, err := os.OpenFile(fileName, journalFlag|os.O_CREATE, 0666)
+	if err != nil {
+		return fmt.Errorf("in saver.openJournal unable to open journal %q: %v", fileName, err)
+	}
+	if durable(s.C.Fsync, atChunk) {
+		err = storage.SyncDir(filepath.Dir(fileName))
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	ss.J = repo.NewFileInfo(f, 0)
+
+	_, err = ss.H.acquire(ss.J, journalFlag)
+	ss.H.release(ss.J)
+
+	return err
+}
+
+// journal appends r to journal of session and flushes it to disk
+func (ss *session) journal(r record) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("in saver.journal unable to marshal record %v: %v", r, err)
+	}
+	f, err := ss.H.acquire(ss.J, journalFlag)
+	if err != nil {
+		return err
+	}
+	defer ss.H.release(ss.J)
+
+	_, err = f.Write(append(line, '\n'))
+	if err != nil {
+		return fmt.Errorf("in saver.journal unable to write to journal %q: %v", ss.J.Path, err)
+	}
+	if !durable(ss.fsync, atChunk) {
+		ss.dirty = true
+		return nil
+	}
+	return storage.SyncFile(f)
+}
+
+func (ss *session) closeJournal() error {
+	if ss.J == nil {
+		return nil
+	}
+	err := ss.H.remove(ss.J)
+	ss.J = nil
+
+	return err
+}
+
+// dropJournal removes journal of session which is no longer assembled.
+// Watermarks are saved beforehand, so that positions of its messages stay known
+func (s *SaverStruct) dropJournal(ss *session) error {
+	err := ss.closeJournal()
+	if err != nil {
+		logger.L.Warnf("in saver.dropJournal unable to close journal of %q: %v\n", ss.Ts, err)
+	}
+	err = s.saveWatermarks()
+	if err != nil {
+		return err
+	}
+	fileName := s.journalName(ss.Ts)
+
+	err = os.Remove(fileName)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("in saver.dropJournal unable to remove journal %q: %v", fileName, err)
+	}
+	return nil
+}
+
+// saveWatermarks replaces watermarks file with current offsets.
+// Offsets to be saved again go first, so that watermarks never cover lost message which is not known to be lost
+func (s *SaverStruct) saveWatermarks() error {
+	s.wl.Lock()
+	defer s.wl.Unlock()
+
+	replay := make(map[int][]int64)
+	s.l.Lock()
+	for p := range s.U {
+		replay[p.Partition] = append(replay[p.Partition], p.Offset)
+	}
+	watermarks, err := json.Marshal(s.W)
+	s.l.Unlock()
+	if err != nil {
+		return fmt.Errorf("in saver.saveWatermarks unable to marshal watermarks: %v", err)
+	}
+	replayed, err := json.Marshal(replay)
+	if err != nil {
+		return fmt.Errorf("in saver.saveWatermarks unable to marshal offsets to be saved again: %v", err)
+	}
+	err = s.replaceFile(replayFile, replayed)
+	if err != nil {
+		return err
+	}
+	return s.replaceFile(watermarksFile, watermarks)
+}
+
+// replaceFile replaces file name of journal folder with data at once
+func (s *SaverStruct) replaceFile(name string, data []byte) error {
+	folderName := filepath.Join(s.Path, journalFolder)
+	fileName := filepath.Join(folderName, name)
+
+	err := os.MkdirAll(folderName, 0777)
+	if err != nil {
+		return fmt.Errorf("in saver.replaceFile unable to create folder %q: %v", folderName, err)
+	}
+	tmpName := fileName + ".tmp"
+
+	f, err := os.Create(tmpName)
+	if err != nil {
+		return fmt.Errorf("in saver.replaceFile unable to create file %q: %v", tmpName, err)
+	}
+	_, err = f.Write(data)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("in saver.replaceFile unable to write to file %q: %v", tmpName, err)
+	}
+	if durable(s.C.Fsync, atClose) {
+		err = storage.SyncFile(f)
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	f.Close()
+
+	err = os.Rename(tmpName, fileName)
+	if err != nil {
+		return fmt.Errorf("in saver.replaceFile unable to rename %q to %q: %v", tmpName, fileName, err)
+	}
+	if !durable(s.C.Fsync, atClose) {
+		return nil
+	}
+	return storage.SyncDir(folderName)
+}
+
+// loadWatermarks reads offsets and submissions given up saved by previous run, if any
+func (s *SaverStruct) loadWatermarks() error {
+	err := s.loadFile(watermarksFile, &s.W)
+	if err != nil {
+		return err
+	}
+	replay := make(map[int][]int64)
+
+	err = s.loadFile(replayFile, &replay)
+	if err != nil {
+		return err
+	}
+	err = s.loadFile(rejectedFile, &s.X)
+	if err != nil {
+		return err
+	}
+	for partition, offsets := range replay {
+		for _, o := range offsets {
+			s.U[repo.Position{Partition: partition, Offset: o}] = true
+		}
+	}
+	return nil
+}
+
+// loadFile unmarshals file name of journal folder into v, missing file leaves v as it is
+func (s *SaverStruct) loadFile(name string, v interface{}) error {
+	fileName := filepath.Join(s.Path, journalFolder, name)
+
+	bs, err := os.ReadFile(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("in saver.loadFile unable to read file %q: %v", fileName, err)
+	}
+	err = json.Unmarshal(bs, v)
+	if err != nil {
+		return fmt.Errorf("in saver.loadFile unable to unmarshal file %q: %v", fileName, err)
+	}
+	return nil
+}
+
+// readJournal returns records of journal fileName.
+// Record torn by crash can only be the last one, it is cut off
+func readJournal(fileName string) ([]record, error) {
+	f, err := os.OpenFile(fileName, os.O_RDWR, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("in saver.readJournal unable to open journal %q: %v", fileName, err)
+	}
+	defer f.Close()
+
+	var (
+		records = make([]record, 0, 15)
+		good    int64
+		rd      = bufio.NewReader(f)
+	)
+	for {
+		line, err := rd.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("in saver.readJournal unable to read journal %q: %v", fileName, err)
+		}
+		r := record{}
+		if !bytes.HasSuffix(line, []byte("\n")) || json.Unmarshal(line, &r) != nil {
+			break
+		}
+		records = append(records, r)
+		good += int64(len(line))
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("in saver.readJournal unable to stat journal %q: %v", fileName, err)
+	}
+	if info.Size() > good {
+		logger.L.Warnf("in saver.readJournal journal %q has torn tail of %d bytes, cutting it off\n", fileName, info.Size()-good)
+
+		err = f.Truncate(good)
+		if err != nil {
+			return nil, fmt.Errorf("in saver.readJournal unable to truncate journal %q: %v", fileName, err)
+		}
+	}
+	return records, nil
+}
+
+// restore rebuilds sessions of submissions left unfinished by previous run from their journals.
+// Files are cut to journaled sizes, so chunks written but not journaled are saved again when redelivered
+func (s *SaverStruct) restore() error {
+	folderName := filepath.Join(s.Path, journalFolder)
+
+	err := s.loadWatermarks()
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(folderName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("in saver.restore unable to read folder %q: %v", folderName, err)
+	}
+	for _, e := range entries {
+		ts := e.Name()
+		if strings.HasPrefix(ts, ".") || e.IsDir() {
+			continue
+		}
+		err = s.restoreSession(ts)
+		if err != nil {
+			logger.L.Errorf("in saver.restore unable to restore submission %q: %v\n", ts, err)
+		}
+	}
+	return nil
+}
+
+func (s *SaverStruct) restoreSession(ts string) error {
+	err := repo.CheckTS(ts)
+	if err != nil {
+		return err
+	}
+	records, err := readJournal(s.journalName(ts))
+	if err != nil {
+		return err
+	}
+	ss := newSession(ts, filepath.Join(s.Path, stagingFolder, ts), s.C.Fsync, s.H, s.streamer())
+	last := false
+	for _, r := range records {
+		s.markSaved(repo.Position{Partition: r.Partition, Offset: r.Offset})
+		last = last || r.Last
+	}
+
+	_, err = os.Stat(ss.Path)
+	switch {
+	case last && err == nil:
+		// crashed between completion and publishing
+		err = s.publish(ss)
+		if err != nil {
+			return err
+		}
+		logger.L.Infof("in saver.restoreSession completed submission %q is published\n", ts)
+		return s.dropJournal(ss)
+	case os.IsNotExist(err):
+		// published or abandoned already
+		return s.dropJournal(ss)
+	case err != nil:
+		return fmt.Errorf("in saver.restoreSession unable to stat %q: %v", ss.Path, err)
+	}
+	if st, ok := s.D.(storage.Streamer); ok {
+		// streamed data not sent yet was kept in memory and is lost, so submission cannot be resumed.
+		// Its offsets have not been committed, it is assembled again from redelivered messages
+		s.l.Lock()
+		for _, r := range records {
+			s.U[repo.Position{Partition: r.Partition, Offset: r.Offset}] = true
+		}
+		s.l.Unlock()
+
+		err = s.saveWatermarks()
+		if err != nil {
+			return err
+		}
+		err = st.AbortAll(ts + "/")
+		if err != nil {
+			return err
+		}
+		logger.L.Warnf("in saver.restoreSession streamed submission %q cannot be resumed, it is saved again from %d redelivered messages\n", ts, len(records))
+		return s.discard(ss, true)
+	}
+
+	err = s.reopen(ss, replay(ss, records))
+	if err != nil {
+		ss.closeFiles()
+		return err
+	}
+	err = s.openJournal(ss)
+	if err != nil {
+		ss.closeFiles()
+		return err
+	}
+	s.S[ts] = ss
+	logger.L.Infof("in saver.restoreSession submission %q is restored from %d journal records\n", ts, len(records))
+
+	return nil
+}
+
+// replay rebuilds manifest of session from journal records.
+// It returns last records of parts whose files are to be reopened
+func replay(ss *session, records []record) map[part]record {
+	if len(records) > 0 {
+		ss.M.Received = records[0].Time
+	}
+	open := make(map[part]record)
+	for _, r := range records {
+		if len(r.FormName) == 0 {
+			continue
+		}
+		p := part{FormName: r.FormName, Part: r.Part}
+		f := ss.field(p)
+		if r.Sent != nil {
+			ss.V[part{FormName: r.FormName, Part: *r.Sent}] = p
+		}
+
+		switch {
+		case r.Rejected || len(r.Stored) == 0 && r.Quarantined:
+			// dropped chunk
+			if len(f.Kind) == 0 {
+				f.setKind(r.FileName)
+			}
+		case len(r.Stored) == 0:
+			f.addText(r.Text, "")
+		default:
+			ss.N[strings.ToLower(r.Stored)] = true
+			switch {
+			case len(r.FileName) == 0:
+				f.Kind, f.Path, f.Value = KindText, ss.Ts+"/"+r.Stored, ""
+			case f.Kind != KindFile:
+				f.Kind, f.FileName, f.Path = KindFile, r.FileName, ss.Ts+"/"+r.Stored
+			}
+			if len(r.ChunkSHA256) > 0 {
+				f.ChunkSHA256 = append(f.ChunkSHA256, r.ChunkSHA256)
+			}
+			f.Size = r.Size
+			f.Chunks++
+			open[p] = r
+		}
+		if r.Quarantined && !f.Quarantined {
+			f.Quarantined, f.Path, f.Value = true, "", ""
+			if len(r.Stored) > 0 {
+				f.Path = quarantinePath(ss.Ts, r.Stored)
+			}
+			delete(open, p)
+		}
+	}
+	return open
+}
+
+// reopen cuts files of parts to journaled sizes. Files are left closed, they are opened by handle cache with next chunk.
+// Digests and content types are not journaled, they are taken from what is on disk
+func (s *SaverStruct) reopen(ss *session, open map[part]record) error {
+	for p, r := range open {
+		fileName := filepath.Join(ss.Path, r.Stored)
+
+		f, err := os.OpenFile(fileName, os.O_RDWR, 0666)
+		if os.IsNotExist(err) {
+			if _, qerr := os.Stat(filepath.Join(s.Path, quarantinePath(ss.Ts, r.Stored))); qerr == nil {
+				// crashed between quarantining file and journaling it
+				ss.I[p].Quarantined, ss.I[p].Path = true, quarantinePath(ss.Ts, r.Stored)
+				continue
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("in saver.reopen unable to open file %q: %v", fileName, err)
+		}
+		err = ss.cut(p, f, r.Size)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		ss.F[p] = &repo.FileInfo{O: r.Size, Path: fileName}
+	}
+	for _, f := range ss.M.Fields {
+		if !f.Quarantined || len(f.Path) == 0 {
+			continue
+		}
+		fileName := filepath.Join(s.Path, filepath.FromSlash(f.Path))
+
+		qf, err := os.Open(fileName)
+		if err != nil {
+			return fmt.Errorf("in saver.reopen unable to open file %q: %v", fileName, err)
+		}
+		err = f.rehash(qf)
+		qf.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cut truncates file of part p to journaled size and rehashes it
+func (ss *session) cut(p part, f *os.File, size int64) error {
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("in saver.cut unable to stat file %q: %v", f.Name(), err)
+	}
+	if info.Size() < size {
+		logger.L.Errorf("in saver.cut file %q is %d bytes shorter than journaled, data not flushed to disk is lost\n", f.Name(), size-info.Size())
+	}
+
+	err = f.Truncate(size)
+	if err != nil {
+		return fmt.Errorf("in saver.cut unable to truncate file %q: %v", f.Name(), err)
+	}
+	return ss.I[p].rehash(f)
+}
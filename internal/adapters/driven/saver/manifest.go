@@ -0,0 +1,146 @@
+package saver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ManifestVersion is written to every manifest and bumped on incompatible changes of its layout,
+// so that consumers can tell which layout they read
+const ManifestVersion = 1
+
+const (
+	KindFile = "file"
+	KindText = "text"
+)
+
+// manifest describes submission, it is saved as <ts>.json in submission folder
+type manifest struct {
+	Version   int        `json:"version"`
+	Ts        string     `json:"ts"`
+	Received  time.Time  `json:"received"`            // when first chunk came
+	Completed *time.Time `json:"completed,omitempty"` // absent for unfinished submission
+	Fields    []*field   `json:"fields"`              // in order of arrival
+}
+
+func newManifest(ts string, received time.Time) *manifest {
+	return &manifest{
+		Version:  ManifestVersion,
+		Ts:       ts,
+		Received: received,
+		Fields:   make([]*field, 0, 15),
+	}
+}
+
+// field describes form field of submission
+type field struct {
+	Name        string   `json:"name"`
+	Part        uint32   `json:"part"` // index of value of repeated field
+	Kind        string   `json:"kind"`
+	Value       string   `json:"value,omitempty"`       // text field value, unless it is saved to file
+	FileName    string   `json:"fileName,omitempty"`    // name sent by client
+	Path        string   `json:"path,omitempty"`        // file relative to results folder
+	Size        int64    `json:"size"`                  // in bytes
+	SHA256      string   `json:"sha256,omitempty"`      // hex encoded digest of file, or of text value saved to file
+	ChunkSHA256 []string `json:"chunkSha256,omitempty"` // hex encoded digests of file chunks
+	ContentType string   `json:"contentType,omitempty"` // guessed from file name or content
+	Chunks      int      `json:"chunks"`
+	Quarantined bool     `json:"quarantined,omitempty"` // file does not match expected digest, path points to quarantine folder unless file is discarded
+	h           hash.Hash
+}
+
+// field returns manifest field describing part p, adding it on first use
+func (ss *session) field(p part) *field {
+	if f, ok := ss.I[p]; ok {
+		return f
+	}
+	f := &field{Name: p.FormName, Part: p.Part}
+	ss.M.Fields = append(ss.M.Fields, f)
+	ss.I[p] = f
+
+	return f
+}
+
+// setKind sets kind of field by name of file sent, which is empty for text field
+func (f *field) setKind(fileName string) {
+	if len(fileName) == 0 {
+		f.Kind = KindText
+		return
+	}
+	f.Kind, f.FileName = KindFile, fileName
+}
+
+// addChunk accounts chunk of file sent as fileName and stored at path
+func (f *field) addChunk(fileName, path string, chunk []byte) {
+	if f.Kind != KindFile {
+		f.Kind, f.FileName, f.Path = KindFile, fileName, path
+		f.ContentType = contentType(fileName, chunk)
+		f.h = sha256.New()
+	}
+	f.h.Write(chunk)
+	f.SHA256 = hex.EncodeToString(f.h.Sum(nil))
+
+	sum := sha256.Sum256(chunk)
+	f.ChunkSHA256 = append(f.ChunkSHA256, hex.EncodeToString(sum[:]))
+	f.Size += int64(len(chunk))
+	f.Chunks++
+}
+
+// addText accounts chunk of text field, path is set when value is saved to file.
+// Value saved to file is hashed as file is, starting with the part of it kept inline before
+func (f *field) addText(chunk []byte, path string) {
+	f.Kind = KindText
+	if len(path) > 0 {
+		if f.h == nil {
+			f.h = sha256.New()
+			f.h.Write([]byte(f.Value))
+		}
+		f.h.Write(chunk)
+		f.SHA256 = hex.EncodeToString(f.h.Sum(nil))
+		f.Path, f.Value = path, ""
+	} else {
+		f.Value += string(chunk)
+	}
+	f.Size += int64(len(chunk))
+	f.Chunks++
+}
+
+// contentType guesses media type of file by extension of its name,
+// falling back to sniffing its first bytes
+func contentType(fileName string, head []byte) string {
+	if t := mime.TypeByExtension(filepath.Ext(fileName)); len(t) > 0 {
+		return t
+	}
+	return http.DetectContentType(head)
+}
+
+// rehash recounts digest and size of field from contents of its file, and content type of file field
+func (f *field) rehash(file *os.File) error {
+	if f.Kind == KindFile {
+		head := make([]byte, 512)
+		n, err := file.ReadAt(head, 0)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("in saver.rehash unable to read file %q: %v", file.Name(), err)
+		}
+		f.ContentType = contentType(f.FileName, head[:n])
+	}
+	f.h = sha256.New()
+
+	size, err := io.Copy(f.h, io.NewSectionReader(file, 0, math.MaxInt64))
+	if err != nil {
+		return fmt.Errorf("in saver.rehash unable to read file %q: %v", file.Name(), err)
+	}
+	f.Size = size
+	f.SHA256 = hex.EncodeToString(f.h.Sum(nil))
+
+	return nil
+}
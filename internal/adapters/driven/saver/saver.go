@@ -3,174 +3,846 @@
 package saver
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"sync"
+	"time"
 
 	json "github.com/goccy/go-json"
+	"github.com/vynovikov/highLoadSaver/internal/adapters/driven/storage"
 	"github.com/vynovikov/highLoadSaver/internal/adapters/driver/rpc/pb"
+	"github.com/vynovikov/highLoadSaver/internal/config"
+	"github.com/vynovikov/highLoadSaver/internal/logger"
+	"github.com/vynovikov/highLoadSaver/internal/metrics"
 	"github.com/vynovikov/highLoadSaver/internal/repo"
 )
 
 type Saver interface {
-	Save(*pb.MessageHeader) error
+	Save(*pb.MessageHeader, *pb.MessageBody, repo.Position) error
+	Abandon(string, bool) error
+	Reject(string, bool) error
+	Purge(time.Duration) error
+	Pending() []string
+	Committable(repo.Position) int64
+	Resume(int) int64
+	Skip(repo.Position) error
+	Close() error
 }
 
+const (
+	// stagingFolder keeps submissions while they are being assembled
+	stagingFolder = ".staging"
+	// abandonedFolder keeps submissions that were never completed
+	abandonedFolder = ".abandoned"
+	// quarantineFolder keeps files not matching their expected digest, in subfolder per ts
+	quarantineFolder = ".quarantine"
+	// maxGivenUp bounds number of submissions given up that are remembered, the oldest ones are forgotten first
+	maxGivenUp = 10000
+)
+
 type SaverStruct struct {
 	Path string
-	F    map[string]*repo.FileInfo
-	T    map[string]string
+	C    *config.Config
+	S    map[string]*session      // sessions keyed by ts
+	W    map[int]int64            // offsets of last saved messages keyed by partition
+	U    map[repo.Position]bool   // positions up to watermarks whose streamed data was lost, they are saved again when redelivered
+	O    map[string]map[int]int64 // offsets of first messages of streamed submissions not published yet, keyed by ts and partition
+	X    map[string]time.Time     // when submissions were given up keyed by ts, their chunks are rejected
+	H    *handleCache             // bounds number of open files of all sessions
+	D    storage.Driver           // keeps published submissions
 	l    sync.Mutex
+	wl   sync.Mutex    // serializes saving of watermarks
+	stop chan struct{} // stops periodic flushing
+	// closed saver rejects new chunks
+	closed bool
 }
 
-func NewSaver(path string) (*SaverStruct, error) {
-	f := make(map[string]*repo.FileInfo)
-	t := make(map[string]string)
-	_, err := os.Stat(path)
-
+// NewSaver returns saver storing submissions under results path of c.
+// Path is created if missing and must be a writable folder.
+// Submissions left unfinished by previous run are restored from their journals
+func NewSaver(c *config.Config) (*SaverStruct, error) {
+	d, err := storage.New(c)
 	if err != nil {
+		return &SaverStruct{}, err
+	}
+	return newSaver(c, d)
+}
 
-		if os.IsNotExist(err) {
+// newSaver returns saver publishing submissions to storage d
+func newSaver(c *config.Config, d storage.Driver) (*SaverStruct, error) {
+	ss := make(map[string]*session)
+	w := make(map[int]int64)
 
-			os.Mkdir(path, 0777)
+	err := checkFolder(c.ResultsPath)
+	if err != nil {
+		return &SaverStruct{}, err
+	}
+	s := &SaverStruct{
+		Path: c.ResultsPath,
+		C:    c,
+		S:    ss,
+		W:    w,
+		U:    make(map[repo.Position]bool),
+		O:    make(map[string]map[int]int64),
+		X:    make(map[string]time.Time),
+		H:    newHandleCache(c.MaxOpenFiles, c.Fsync),
+		D:    d,
+		stop: make(chan struct{}),
+	}
 
-			return &SaverStruct{Path: path, F: f, T: t}, nil
-		}
+	err = s.restore()
+	if err != nil {
 		return &SaverStruct{}, err
 	}
-	return &SaverStruct{Path: path, F: f, T: t}, nil
+	metrics.FsyncPolicy.Set(c.Fsync)
+	if c.Fsync == config.FsyncPeriodic {
+		go s.flushLoop(c.FsyncInterval, s.stop)
+	}
+	return s, nil
+}
+
+// checkFolder makes sure that path exists, is a folder and is writable
+func checkFolder(path string) error {
+	if len(path) == 0 {
+		return fmt.Errorf("in saver.checkFolder results path is empty")
+	}
+	err := os.MkdirAll(path, 0777)
+	if err != nil {
+		return fmt.Errorf("in saver.checkFolder unable to create folder %q: %v", path, err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("in saver.checkFolder unable to stat %q: %v", path, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("in saver.checkFolder %q is not a folder", path)
+	}
+	f, err := os.CreateTemp(path, ".probe-*")
+	if err != nil {
+		return fmt.Errorf("in saver.checkFolder folder %q is not writable: %v", path, err)
+	}
+	f.Close()
+
+	err = os.Remove(f.Name())
+	if err != nil {
+		return fmt.Errorf("in saver.checkFolder unable to remove probe file %q: %v", f.Name(), err)
+	}
+	return nil
+}
+
+// Save stores body chunk to the file described by header.
+// Submission is assembled in staging folder. Body marked as last completes it:
+// table is saved, files are closed and submission folder is moved to results folder at once.
+// Messages at positions that have already been saved are skipped, so redelivered ones do not duplicate data.
+// Errors are transient unless they are marked permanent, message failed transiently may be retried safely.
+// Safe for concurrent use, chunks of different submissions are saved independently
+func (s *SaverStruct) Save(h *pb.MessageHeader, b *pb.MessageBody, p repo.Position) error {
+	if s.isSaved(p) {
+		logger.L.Warnf("in saver.Save message at partition %d offset %d is already saved, skipping\n", p.Partition, p.Offset)
+		return nil
+	}
+	err := s.save(h, b, p)
+	if err != nil {
+		return err
+	}
+	s.markSaved(p)
+
+	return nil
 }
 
-func (s *SaverStruct) Save(m *pb.MessageHeader) error {
-	if len(s.T) == 0 {
-		err := s.createFolder(m.Ts)
+// save applies message at position p to its submission and journals it.
+// Message applied by failed attempt is not applied again when it is retried, it is only finished
+func (s *SaverStruct) save(h *pb.MessageHeader, b *pb.MessageBody, p repo.Position) error {
+	err := repo.CheckTS(h.Ts)
+	if err != nil {
+		return repo.Permanent(err)
+	}
+	ss, err := s.session(h.Ts)
+	if err != nil {
+		return err
+	}
+	ss.l.Lock()
+	defer ss.l.Unlock()
+
+	if ss.P != nil && ss.P.p == p {
+		return s.finish(ss)
+	}
+	if ss.done {
+		return repo.Permanent(fmt.Errorf("in saver.Save submission %q is already completed", h.Ts))
+	}
+	if ss.P != nil {
+		// message given up after it was applied is journaled before next one
+		err = s.finish(ss)
+		if err != nil {
+			return err
+		}
+	}
+	r := record{Partition: p.Partition, Offset: p.Offset, Time: time.Now(), FormName: h.FormName, Part: h.Part, Last: b.Last}
+	if len(h.FormName) > 0 {
+		err = s.saveField(ss, h, b, &r)
 		if err != nil {
 			return err
 		}
 	}
-	//logger.L.Infof("in saver.Save receiving m %v, s.T became %v\n", m, s.T)
-	if len(m.FormName) > 0 {
-		if len(m.FileName) > 0 {
-			filePath, err := s.saveToFile(m)
+	if b.Last {
+		ss.M.Completed = &r.Time
+		ss.done = true
+	}
+	ss.P = &progress{p: p, r: r}
+	if ss.D != nil {
+		s.hold(ss.Ts, p)
+	}
+
+	return s.finish(ss)
+}
+
+// finish journals message applied to session and publishes submission if message completes it.
+// Steps taken are recorded, so that retry of failed message resumes from the step it failed at
+func (s *SaverStruct) finish(ss *session) error {
+	pr := ss.P
+	if !pr.journaled {
+		if pr.r.Last {
+			err := ss.saveToTable()
 			if err != nil {
 				return err
 			}
-			if _, ok := s.T[m.FormName]; !ok {
-				s.T[m.FormName] = filePath
+			if errs := ss.closeFiles(); len(errs) > 0 {
+				return fmt.Errorf("in saver.finish unable to close files: %v", errs)
+			}
+		}
+		err := ss.journal(pr.r)
+		if err != nil {
+			return err
+		}
+		pr.journaled = true
+	}
+	if !pr.r.Last {
+		ss.P = nil
+		return nil
+	}
+	if !pr.published {
+		// unpublished submission stays registered, so that its staging folder is not reused
+		err := s.publish(ss)
+		if err != nil {
+			return err
+		}
+		pr.published = true
+	}
+	s.markSaved(pr.p)
+
+	err := s.dropJournal(ss)
+	if err != nil {
+		return err
+	}
+	ss.P = nil
+	s.remove(ss.Ts)
+
+	return nil
+}
+
+// saveField saves chunk of form field described by h, filling in journal record r.
+// Part having chunk not matching its digest or file not matching expected digest is quarantined
+func (s *SaverStruct) saveField(ss *session, h *pb.MessageHeader, b *pb.MessageBody, r *record) error {
+	hp := ss.headerPart(h)
+	r.Part = hp.Part
+	if hp.Part != h.Part {
+		sent := h.Part
+		r.Sent = &sent
+	}
+	if f, ok := ss.I[hp]; ok && f.Quarantined {
+		logger.L.Warnf("in saver.saveField part %d of field %q of %q is quarantined, chunk is dropped\n", hp.Part, h.FormName, h.Ts)
+		r.Quarantined = true
+		return nil
+	}
+	if len(b.ChunkSha256) > 0 {
+		if sum := sha256.Sum256(b.Body); !bytes.Equal(sum[:], b.ChunkSha256) {
+			// following chunks cannot be appended to part with gap, so it is quarantined as a whole
+			logger.L.Errorf("in saver.saveField chunk of part %d of field %q of %q does not match its digest\n", hp.Part, h.FormName, h.Ts)
+			f := ss.field(hp)
+			if len(f.Kind) == 0 {
+				f.setKind(h.FileName)
 			}
+			r.FileName, r.Quarantined, r.Rejected = h.FileName, true, true
+			r.Stored, r.Size, _ = ss.stored(hp)
+			return s.quarantine(ss, hp)
+		}
+	}
+	metrics.Chunks.Add(1)
+	metrics.Bytes.Add(int64(len(b.Body)))
+	if len(h.FileName) == 0 {
+		err := ss.saveText(hp, b.Body, s.C.TextInlineLimit)
+		if err != nil {
+			return err
+		}
+		if stored, size, ok := ss.stored(hp); ok {
+			r.Stored, r.Size = stored, size
 		} else {
-			s.T[m.FormName] = string(m.FormName)
+			r.Text = b.Body
 		}
+		return nil
+	}
+	filePath, err := ss.saveToFile(hp, h.FileName, b.Body)
+	if err != nil {
+		return err
+	}
+	f := ss.field(hp)
+	f.addChunk(h.FileName, filePath, b.Body)
+
+	stored, size, _ := ss.stored(hp)
+	r.FileName, r.Stored, r.Size = h.FileName, stored, size
+	r.ChunkSHA256 = f.ChunkSHA256[len(f.ChunkSHA256)-1]
+
+	if len(b.Sha256) > 0 && !bytes.Equal(f.h.Sum(nil), b.Sha256) {
+		r.Quarantined = true
+		return s.quarantine(ss, hp)
 	}
+	return nil
+}
 
-	//logger.L.Infof("in saver.Save after receiving m %v, s.T became %v\n", m, s.T)
+// quarantine moves file of part p out of submission into quarantine folder.
+// Streamed file cannot be moved, it is discarded
+func (s *SaverStruct) quarantine(ss *session, p part) error {
+	f := ss.I[p]
+	FI, ok := ss.F[p]
+	if _, streamed := ss.O[p]; !ok && !streamed {
+		// nothing is saved to file yet, value kept in manifest is dropped
+		f.Quarantined, f.Path, f.Value = true, "", ""
+		logger.L.Errorf("in saver.quarantine part %d of field %q of %q does not match expected digest and is discarded\n", p.Part, p.FormName, ss.Ts)
 
-	if m.First {
-		err := s.saveToTable(m)
+		return nil
+	}
+	if st, ok := ss.O[p]; ok {
+		err := st.o.Abort()
 		if err != nil {
 			return err
 		}
-		s.closeFiles()
-		s.reset()
+		delete(ss.O, p)
+		f.Quarantined, f.Path = true, ""
+		logger.L.Errorf("in saver.quarantine file %q of field %q of %q does not match expected digest and is discarded\n", f.FileName, p.FormName, ss.Ts)
+
+		return nil
+	}
+	stored := filepath.Base(FI.Path)
+
+	err := s.moveToQuarantine(ss.Ts, FI.Path)
+	if err != nil {
+		return err
+	}
+	err = ss.H.remove(FI)
+	if err != nil {
+		logger.L.Warnf("in saver.quarantine %v\n", err)
+	}
+	delete(ss.F, p)
+
+	f.Quarantined, f.Path = true, quarantinePath(ss.Ts, stored)
+	logger.L.Errorf("in saver.quarantine file %q of field %q of %q does not match expected digest and is quarantined\n", f.FileName, p.FormName, ss.Ts)
+
+	return nil
+}
+
+// moveToQuarantine moves file fileName of submission ts into quarantine folder
+func (s *SaverStruct) moveToQuarantine(ts, fileName string) error {
+	folderName := filepath.Join(s.Path, quarantineFolder, ts)
+	err := os.MkdirAll(folderName, 0777)
+	if err != nil {
+		return fmt.Errorf("in saver.moveToQuarantine unable to create folder %q: %v", folderName, err)
+	}
+	target := filepath.Join(folderName, filepath.Base(fileName))
+	err = os.Rename(fileName, target)
+	if err != nil {
+		return fmt.Errorf("in saver.moveToQuarantine unable to move file %q to %q: %v", fileName, target, err)
+	}
+	if !durable(s.C.Fsync, atClose) {
+		return nil
+	}
+	err = storage.SyncDir(folderName)
+	if err != nil {
+		return err
+	}
+	return storage.SyncDir(filepath.Dir(fileName))
+}
+
+// quarantinePath returns path of quarantined file relative to results folder
+func quarantinePath(ts, stored string) string {
+	return quarantineFolder + "/" + ts + "/" + stored
+}
+
+// publish moves completed submission from staging folder to storage.
+// Local storage takes folder over by atomic rename, so readers of results folder never see incomplete submission,
+// other storages get it uploaded
+func (s *SaverStruct) publish(ss *session) error {
+	m, ok := s.D.(storage.Mover)
+	if !ok {
+		return s.upload(ss)
+	}
+	err := m.Move(ss.Path, ss.Ts)
+	if err != nil {
+		// wrapped, so that conflict stays permanent
+		return fmt.Errorf("in saver.publish unable to publish submission %q, it is kept in %q: %w", ss.Ts, ss.Path, err)
 	}
 	return nil
 }
-func (s *SaverStruct) createFolder(ts string) error {
-	folderName := "results" + "/" + ts
-	err := os.Mkdir(folderName, 0777)
+
+// upload copies files of completed submission to storage and removes its staging folder.
+// Manifest goes last, so that submission without it is known to be incomplete and is overwritten by next attempt
+func (s *SaverStruct) upload(ss *session) error {
+	manifestName := ss.Ts + ".json"
+
+	keys, err := s.D.List(ss.Ts + "/" + manifestName)
+	if err != nil {
+		return fmt.Errorf("in saver.upload unable to list submission %q: %v", ss.Ts, err)
+	}
+	for _, k := range keys {
+		if k == ss.Ts+"/"+manifestName {
+			return repo.Permanent(fmt.Errorf("in saver.upload submission %q is already published, it is kept in %q", ss.Ts, ss.Path))
+		}
+	}
+	entries, err := os.ReadDir(ss.Path)
+	if err != nil {
+		return fmt.Errorf("in saver.upload unable to read folder %q: %v", ss.Path, err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.Name() != manifestName {
+			names = append(names, e.Name())
+		}
+	}
+	names = append(names, manifestName)
+
+	for i, name := range names {
+		err = s.uploadFile(filepath.Join(ss.Path, name), ss.Ts+"/"+name)
+		if err == nil {
+			continue
+		}
+		for _, uploaded := range names[:i] {
+			if derr := s.D.Delete(ss.Ts + "/" + uploaded); derr != nil {
+				logger.L.Warnf("in saver.upload %v\n", derr)
+			}
+		}
+		return fmt.Errorf("in saver.upload unable to publish submission %q, it is kept in %q: %w", ss.Ts, ss.Path, err)
+	}
+	err = os.RemoveAll(ss.Path)
 	if err != nil {
-		return fmt.Errorf("in saver.createFolder unable to create folder %q: %v", folderName, err)
+		return fmt.Errorf("in saver.upload unable to remove folder %q: %v", ss.Path, err)
 	}
 	return nil
 }
 
-func (s *SaverStruct) getFileForMessageSaving(m *pb.MessageHeader) (*repo.FileInfo, error) {
-	var (
-		f        *os.File
-		err      error
-		fileName string
-	)
-	folderName := "results" + "/" + m.Ts
-	fileName = folderName + "/" + m.FileName
+// uploadFile copies file fileName to object key
+func (s *SaverStruct) uploadFile(fileName, key string) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return fmt.Errorf("in saver.uploadFile unable to open file %q: %v", fileName, err)
+	}
+	defer f.Close()
+
+	o, err := s.D.Create(key)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(io.NewOffsetWriter(o, 0), f)
+	if err != nil {
+		o.Abort()
+		return fmt.Errorf("in saver.uploadFile unable to copy file %q: %v", fileName, err)
+	}
+	return o.Finalize()
+}
+
+// Abandon closes files of unfinished submission ts and moves its folder aside,
+// or deletes it if remove is set. Completed submissions are left intact.
+// Chunks of abandoned submission coming afterwards are rejected, so that it is never published with chunks missing
+func (s *SaverStruct) Abandon(ts string, remove bool) error {
+	s.l.Lock()
+	ss, ok := s.S[ts]
+	s.l.Unlock()
+
+	if !ok {
+		return nil
+	}
+	ss.l.Lock()
+	defer ss.l.Unlock()
+
+	if ss.done {
+		return nil
+	}
+	ss.done = true
+	// late chunk would start submission anew otherwise
+	givenUp := s.giveUp(ts)
 
-	if FI, ok := s.F[m.FormName]; ok {
-		return FI, nil
+	if errs := ss.abortStreams(); len(errs) > 0 {
+		logger.L.Warnf("in saver.Abandon unable to abort streamed files of %q: %v\n", ts, errs)
+	}
+	if errs := ss.closeFiles(); len(errs) > 0 {
+		logger.L.Warnf("in saver.Abandon unable to close files of %q: %v\n", ts, errs)
+	}
+	if err := ss.closeJournal(); err != nil {
+		logger.L.Warnf("in saver.Abandon unable to close journal of %q: %v\n", ts, err)
+	}
+	err := s.saveWatermarks()
+	if err != nil {
+		return err
+	}
+	err = s.discard(ss, remove)
+	if err != nil {
+		return err
+	}
+	if givenUp != nil {
+		return fmt.Errorf("in saver.Abandon unable to save submissions given up: %v", givenUp)
 	}
-	f, err = os.Create(fileName)
+	return nil
+}
+
+// Reject gives up submission ts which lost some message, abandoning it as Abandon does.
+// It is given up even if none of its chunks has been saved yet, so that they are rejected too
+func (s *SaverStruct) Reject(ts string, remove bool) error {
+	err := s.giveUp(ts)
 	if err != nil {
-		return &repo.FileInfo{}, fmt.Errorf("in saver.ToTable unable to create file %q: %v", fileName, err)
+		return fmt.Errorf("in saver.Reject unable to save submissions given up: %v", err)
 	}
+	return s.Abandon(ts, remove)
+}
 
-	return repo.NewFileInfo(f, 0), nil
+// giveUp records that submission ts is given up, its chunks coming afterwards are rejected.
+// Submission given up already is not recorded again
+func (s *SaverStruct) giveUp(ts string) error {
+	s.wl.Lock()
+	defer s.wl.Unlock()
+
+	s.l.Lock()
+	if _, ok := s.X[ts]; ok {
+		s.l.Unlock()
+		return nil
+	}
+	for len(s.X) >= maxGivenUp {
+		oldest := ""
+		for k, t := range s.X {
+			if len(oldest) == 0 || t.Before(s.X[oldest]) {
+				oldest = k
+			}
+		}
+		delete(s.X, oldest)
+	}
+	s.X[ts] = time.Now()
+	rejected, err := json.Marshal(s.X)
+	s.l.Unlock()
+	if err != nil {
+		return fmt.Errorf("in saver.giveUp unable to marshal submissions given up: %v", err)
+	}
+	return s.replaceFile(rejectedFile, rejected)
 }
 
-func (s *SaverStruct) getFileForTableSaving(ts string) (*repo.FileInfo, error) {
-	var (
-		f        *os.File
-		err      error
-		fileName string
-	)
-	folderName := "results" + "/" + ts
-	fileName = folderName + "/" + ts + ".json"
+// forget forgets submissions given up more than retention ago, their chunks are not rejected anymore
+func (s *SaverStruct) forget(retention time.Duration) error {
+	s.wl.Lock()
+	defer s.wl.Unlock()
 
-	f, err = os.Create(fileName)
+	s.l.Lock()
+	n := len(s.X)
+	for k, t := range s.X {
+		if time.Since(t) > retention {
+			delete(s.X, k)
+		}
+	}
+	if len(s.X) == n {
+		s.l.Unlock()
+		return nil
+	}
+	rejected, err := json.Marshal(s.X)
+	s.l.Unlock()
 	if err != nil {
-		return &repo.FileInfo{}, fmt.Errorf("in saver.ToTable unable to create file %q: %v", fileName, err)
+		return fmt.Errorf("in saver.forget unable to marshal submissions given up: %v", err)
+	}
+	return s.replaceFile(rejectedFile, rejected)
+}
+
+// discard moves staging folder of abandoned session aside or removes it, along with its journal
+func (s *SaverStruct) discard(ss *session, remove bool) error {
+	// registry stays locked until folder and journal are gone, so that new session for ts cannot reuse them
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	delete(s.S, ss.Ts)
+	delete(s.O, ss.Ts)
+
+	var err error
+	if remove {
+		err = os.RemoveAll(ss.Path)
+		if err != nil {
+			return fmt.Errorf("in saver.discard unable to remove folder %q: %v", ss.Path, err)
+		}
+	} else {
+		err = s.moveAside(ss)
+		if err != nil {
+			return err
+		}
 	}
+	fileName := s.journalName(ss.Ts)
 
-	return repo.NewFileInfo(f, 0), nil
+	err = os.Remove(fileName)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("in saver.discard unable to remove journal %q: %v", fileName, err)
+	}
+	return nil
 }
 
-func (s *SaverStruct) saveToFile(m *pb.MessageHeader) (string, error) {
-	FI, err := s.getFileForMessageSaving(m)
+// moveAside moves staging folder of session to abandoned folder
+func (s *SaverStruct) moveAside(ss *session) error {
+	abandonedName := filepath.Join(s.Path, abandonedFolder)
+	err := os.MkdirAll(abandonedName, 0777)
+	if err != nil {
+		return fmt.Errorf("in saver.moveAside unable to create folder %q: %v", abandonedName, err)
+	}
+	target := filepath.Join(abandonedName, ss.Ts)
+	err = os.RemoveAll(target)
+	if err != nil {
+		return fmt.Errorf("in saver.moveAside unable to remove folder %q: %v", target, err)
+	}
+	err = os.Rename(ss.Path, target)
 	if err != nil {
-		return "", err
+		return fmt.Errorf("in saver.moveAside unable to move folder %q to %q: %v", ss.Path, target, err)
 	}
-	//logger.L.Infof("in saver.SaveToFile m.FieldValue = %q, FI = %v", m.FieldValue, FI)
-	n, err := FI.F.WriteAt([]byte(m.FormName), FI.O)
+	// modification time marks the moment of abandonment for Purge
+	now := time.Now()
+	err = os.Chtimes(target, now, now)
 	if err != nil {
-		return "", err
+		return fmt.Errorf("in saver.moveAside unable to touch folder %q: %v", target, err)
 	}
-	k := int64(n)
-	FI.AddOffset(k)
+	return nil
+}
 
-	if _, ok := s.F[m.FormName]; !ok {
-		s.F[m.FormName] = FI
+// Pending returns ts of unfinished submissions, including the ones restored from journals
+func (s *SaverStruct) Pending() []string {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	res := make([]string, 0, len(s.S))
+	for ts := range s.S {
+		res = append(res, ts)
 	}
-	return m.Ts + "/" + m.FileName, nil
+	return res
 }
 
-func (s *SaverStruct) saveToTable(m *pb.MessageHeader) error {
-	FI, err := s.getFileForTableSaving(m.Ts)
+// Purge deletes abandoned submissions that were moved aside more than retention ago
+// and forgets submissions given up more than retention ago
+func (s *SaverStruct) Purge(retention time.Duration) error {
+	err := s.forget(retention)
 	if err != nil {
 		return err
 	}
-	fileName := m.Ts + "/" + m.Ts + ".json"
+	abandonedName := filepath.Join(s.Path, abandonedFolder)
+
+	entries, err := os.ReadDir(abandonedName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("in saver.Purge unable to read folder %q: %v", abandonedName, err)
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return fmt.Errorf("in saver.Purge unable to stat %q: %v", e.Name(), err)
+		}
+		if time.Since(info.ModTime()) <= retention {
+			continue
+		}
+		err = os.RemoveAll(filepath.Join(abandonedName, e.Name()))
+		if err != nil {
+			return fmt.Errorf("in saver.Purge unable to remove %q: %v", e.Name(), err)
+		}
+		logger.L.Infof("in saver.Purge abandoned submission %q is removed\n", e.Name())
+	}
+	return nil
+}
+
+// Close closes files of unfinished submissions and saves their tables as they are.
+// Submissions are left in staging folder along with their journals, so that next run resumes them.
+// Streamed files are left unfinished, their offsets have not been committed, so next run assembles them again.
+// Chunks coming afterwards are rejected
+func (s *SaverStruct) Close() error {
+	s.l.Lock()
+	if !s.closed {
+		close(s.stop)
+	}
+	s.closed = true
+	sessions := make([]*session, 0, len(s.S))
+	for _, ss := range s.S {
+		sessions = append(sessions, ss)
+	}
+	s.S = make(map[string]*session)
+	s.l.Unlock()
+
+	errs := make([]error, 0, len(sessions))
+	for _, ss := range sessions {
+		ss.l.Lock()
+		if !ss.done {
+			ss.done = true
+			if err := ss.saveToTable(); err != nil {
+				errs = append(errs, err)
+			}
+			// streams are neither finalized nor aborted, next run aborts them and saves their messages again
+			ss.O = make(map[part]*stream)
+			errs = append(errs, ss.closeFiles()...)
+			if err := ss.closeJournal(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		ss.l.Unlock()
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("in saver.Close unable to close submissions: %v", errs)
+	}
+	return nil
+}
+
+// session returns session for ts, creating it along with its folder on first use
+func (s *SaverStruct) session(ts string) (*session, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
 
-	JSONed, err := json.MarshalIndent(s.T, "", "  ")
+	if s.closed {
+		return nil, fmt.Errorf("in saver.session unable to save %q, saver is closed", ts)
+	}
+	if _, ok := s.X[ts]; ok {
+		return nil, repo.Permanent(fmt.Errorf("in saver.session unable to save %q, submission is given up", ts))
+	}
+	if ss, ok := s.S[ts]; ok {
+		return ss, nil
+	}
+	err := s.createFolder(ts)
 	if err != nil {
-		return fmt.Errorf("in saver.ToTable unable unmarshal map %v: %v", s.T, err)
+		return nil, err
 	}
-	_, err = FI.F.Write(JSONed)
+	ss := newSession(ts, filepath.Join(s.Path, stagingFolder, ts), s.C.Fsync, s.H, s.streamer())
+
+	err = s.openJournal(ss)
 	if err != nil {
-		return fmt.Errorf("in saver.ToTable unable to write to file %q: %v", fileName, err)
+		return nil, err
+	}
+	s.S[ts] = ss
+
+	return ss, nil
+}
+
+// streamer returns driver if files are streamed straight to it, nil if they are staged
+func (s *SaverStruct) streamer() storage.Driver {
+	if _, ok := s.D.(storage.Streamer); ok {
+		return s.D
 	}
 	return nil
 }
 
-func (s *SaverStruct) closeFiles() []error {
-	errs := make([]error, 0, 15)
-	for _, v := range s.F {
-		//logger.L.Infof("in saver.closeFiles closing file corresponding to %s\n", i)
-		err := v.F.Close()
-		if err != nil {
-			errs = append(errs, err)
+// isSaved reports whether message at p has already been saved.
+// Messages of a partition come in order, so everything up to its last saved offset is saved,
+// unless it was lost with streamed data
+func (s *SaverStruct) isSaved(p repo.Position) bool {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	w, ok := s.W[p.Partition]
+
+	return ok && p.Offset <= w && !s.U[p]
+}
+
+func (s *SaverStruct) markSaved(p repo.Position) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	delete(s.U, p)
+	if w, ok := s.W[p.Partition]; !ok || p.Offset > w {
+		s.W[p.Partition] = p.Offset
+	}
+}
+
+// hold keeps offsets from message at p on from being committed until streamed submission ts is published
+func (s *SaverStruct) hold(ts string, p repo.Position) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	o, ok := s.O[ts]
+	if !ok {
+		o = make(map[int]int64)
+		s.O[ts] = o
+	}
+	if first, ok := o[p.Partition]; !ok || p.Offset < first {
+		o[p.Partition] = p.Offset
+	}
+}
+
+// Committable returns offset up to which partition of handled message at p may be committed, -1 if there is none.
+// Streamed data stays in memory until its submission is published, so offsets of its messages are held back
+// and next run saves them again if it is lost
+func (s *SaverStruct) Committable(p repo.Position) int64 {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	res := p.Offset
+	for _, o := range s.O {
+		if first, ok := o[p.Partition]; ok && first <= res {
+			res = first - 1
+		}
+	}
+	return res
+}
+
+// Resume returns offset partition is to be read from when offsets are not committed: next to last message saved,
+// or first one whose streamed data was lost. It is -1 if no message of partition has been saved
+func (s *SaverStruct) Resume(partition int) int64 {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	w, ok := s.W[partition]
+	if !ok {
+		return -1
+	}
+	res := w + 1
+	for p := range s.U {
+		if p.Partition == partition && p.Offset < res {
+			res = p.Offset
 		}
 	}
-	return errs
+	return res
+}
+
+// Skip marks message at p handled without saving it, e.g. after it is dead-lettered,
+// so that reading from where saver left off does not return to it after restart
+func (s *SaverStruct) Skip(p repo.Position) error {
+	if s.isSaved(p) {
+		return nil
+	}
+	s.markSaved(p)
+
+	return s.saveWatermarks()
+}
+
+// remove unregisters session ts, releasing offsets it holds
+func (s *SaverStruct) remove(ts string) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	delete(s.S, ts)
+	delete(s.O, ts)
 }
 
-func (s *SaverStruct) reset() {
-	s.T = make(map[string]string)
-	s.F = make(map[string]*repo.FileInfo)
+// createFolder creates staging folder of submission ts and journal folder
+func (s *SaverStruct) createFolder(ts string) error {
+	stagingName := filepath.Join(s.Path, stagingFolder)
+	for _, folderName := range []string{filepath.Join(stagingName, ts), filepath.Join(s.Path, journalFolder)} {
+		err := os.MkdirAll(folderName, 0777)
+		if err != nil {
+			return fmt.Errorf("in saver.createFolder unable to create folder %q: %v", folderName, err)
+		}
+	}
+	if !durable(s.C.Fsync, atChunk) {
+		return nil
+	}
+	err := storage.SyncDir(s.Path)
+	if err != nil {
+		return err
+	}
+	return storage.SyncDir(stagingName)
 }
@@ -1,15 +1,1547 @@
 package saver
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	json "github.com/goccy/go-json"
 	"github.com/stretchr/testify/suite"
+	"github.com/vynovikov/highLoadSaver/internal/adapters/driven/storage"
+	"github.com/vynovikov/highLoadSaver/internal/adapters/driver/rpc/pb"
+	"github.com/vynovikov/highLoadSaver/internal/config"
+	"github.com/vynovikov/highLoadSaver/internal/metrics"
+	"github.com/vynovikov/highLoadSaver/internal/repo"
 )
 
 type saverSuite struct {
 	suite.Suite
+	root string
+	cfg  *config.Config
 }
 
 func TestSaverSuite(t *testing.T) {
 	suite.Run(t, new(saverSuite))
 }
+
+func (s *saverSuite) SetupTest() {
+	s.root = filepath.Join(s.T().TempDir(), "results")
+	s.cfg = &config.Config{ResultsPath: s.root, TextInlineLimit: 64 << 10}
+}
+
+// readManifest returns decoded manifest of submission ts kept in folder
+func (s *saverSuite) readManifest(folder, ts string) *manifest {
+	m := &manifest{}
+	bs, err := os.ReadFile(filepath.Join(folder, ts, ts+".json"))
+	s.Require().NoError(err)
+	s.Require().NoError(json.Unmarshal(bs, m))
+	return m
+}
+
+// readTable returns fields of submission ts kept in folder keyed by name, or by name[part] for repeated ones.
+// File fields are described by fileEntry and text fields by their value
+func (s *saverSuite) readTable(folder, ts string) map[string]interface{} {
+	table := make(map[string]interface{})
+	for _, f := range s.readManifest(folder, ts).Fields {
+		key := f.Name
+		if f.Part > 0 {
+			key = fmt.Sprintf("%s[%d]", f.Name, f.Part)
+		}
+		if f.Kind == KindFile {
+			table[key] = fileEntry(f.Path, f.FileName)
+		} else {
+			table[key] = f.Value
+		}
+	}
+	return table
+}
+
+// fileEntry is file field of submission table
+func fileEntry(path, fileName string) map[string]interface{} {
+	return map[string]interface{}{"path": path, "fileName": fileName}
+}
+
+type message struct {
+	h *pb.MessageHeader
+	b *pb.MessageBody
+}
+
+func (s *saverSuite) TestNewSaver() {
+	file := filepath.Join(s.T().TempDir(), "file")
+	s.Require().NoError(os.WriteFile(file, []byte("azaza"), 0666))
+
+	tt := []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{
+			name: "missing folder",
+			path: filepath.Join(s.root, "nested"),
+		},
+		{
+			name: "existing folder",
+			path: s.T().TempDir(),
+		},
+		{
+			name:    "empty path",
+			wantErr: true,
+		},
+		{
+			name:    "file",
+			path:    file,
+			wantErr: true,
+		},
+		{
+			name:    "folder inside file",
+			path:    filepath.Join(file, "results"),
+			wantErr: true,
+		},
+	}
+	for _, v := range tt {
+		s.Run(v.name, func() {
+			sv, err := NewSaver(&config.Config{ResultsPath: v.path})
+
+			if v.wantErr {
+				s.Error(err)
+				return
+			}
+			s.Require().NoError(err)
+			s.Equal(v.path, sv.Path)
+
+			entries, err := os.ReadDir(v.path)
+			s.Require().NoError(err)
+			s.Empty(entries)
+		})
+	}
+}
+
+func (s *saverSuite) TestSave() {
+	tt := []struct {
+		name        string
+		messages    []message
+		wantTables  map[string]map[string]interface{}
+		wantContent map[string][]byte
+	}{
+		{
+			name: "1 file 1 chunk",
+			messages: []message{
+				{
+					h: &pb.MessageHeader{Ts: "001", FormName: "alice", FileName: "first.txt", First: true},
+					b: &pb.MessageBody{Body: []byte("azaza"), Last: true},
+				},
+			},
+			wantTables: map[string]map[string]interface{}{
+				"001": {
+					"alice": fileEntry("001/first.txt", "first.txt"),
+				},
+			},
+			wantContent: map[string][]byte{
+				"001/first.txt": []byte("azaza"),
+			},
+		},
+		{
+			name: "2 files 2 chunks each",
+			messages: []message{
+				{
+					h: &pb.MessageHeader{Ts: "002", FormName: "alice", FileName: "first.txt", First: true},
+					b: &pb.MessageBody{Body: []byte("azaza")},
+				},
+				{
+					h: &pb.MessageHeader{Ts: "002", FormName: "alice", FileName: "first.txt"},
+					b: &pb.MessageBody{Body: []byte("bzbzbz")},
+				},
+				{
+					h: &pb.MessageHeader{Ts: "002", FormName: "bob", FileName: "second.txt"},
+					b: &pb.MessageBody{Body: []byte("11111")},
+				},
+				{
+					h: &pb.MessageHeader{Ts: "002", FormName: "bob", FileName: "second.txt"},
+					b: &pb.MessageBody{Body: []byte("22222"), Last: true},
+				},
+			},
+			wantTables: map[string]map[string]interface{}{
+				"002": {
+					"alice": fileEntry("002/first.txt", "first.txt"),
+					"bob":   fileEntry("002/second.txt", "second.txt"),
+				},
+			},
+			wantContent: map[string][]byte{
+				"002/first.txt":  []byte("azazabzbzbz"),
+				"002/second.txt": []byte("1111122222"),
+			},
+		},
+		{
+			name: "2 submissions interleaved",
+			messages: []message{
+				{
+					h: &pb.MessageHeader{Ts: "003", FormName: "alice", FileName: "first.txt", First: true},
+					b: &pb.MessageBody{Body: []byte("azaza")},
+				},
+				{
+					h: &pb.MessageHeader{Ts: "004", FormName: "alice", FileName: "first.txt", First: true},
+					b: &pb.MessageBody{Body: []byte("11111")},
+				},
+				{
+					h: &pb.MessageHeader{Ts: "003", FormName: "bob", FileName: "second.txt"},
+					b: &pb.MessageBody{Body: []byte("bzbzbz")},
+				},
+				{
+					h: &pb.MessageHeader{Ts: "004", FormName: "alice", FileName: "first.txt"},
+					b: &pb.MessageBody{Body: []byte("22222"), Last: true},
+				},
+				{
+					h: &pb.MessageHeader{Ts: "003", FormName: "bob", FileName: "second.txt"},
+					b: &pb.MessageBody{Body: []byte("czczc"), Last: true},
+				},
+			},
+			wantTables: map[string]map[string]interface{}{
+				"003": {
+					"alice": fileEntry("003/first.txt", "first.txt"),
+					"bob":   fileEntry("003/second.txt", "second.txt"),
+				},
+				"004": {
+					"alice": fileEntry("004/first.txt", "first.txt"),
+				},
+			},
+			wantContent: map[string][]byte{
+				"003/first.txt":  []byte("azaza"),
+				"003/second.txt": []byte("bzbzbzczczc"),
+				"004/first.txt":  []byte("1111122222"),
+			},
+		},
+		{
+			name: "dangerous file names",
+			messages: []message{
+				{
+					h: &pb.MessageHeader{Ts: "005", FormName: "alice", FileName: "../../etc/passwd", First: true},
+					b: &pb.MessageBody{Body: []byte("azaza")},
+				},
+				{
+					h: &pb.MessageHeader{Ts: "005", FormName: "bob", FileName: `C:\Windows\con.txt`},
+					b: &pb.MessageBody{Body: []byte("bzbzb")},
+				},
+				{
+					h: &pb.MessageHeader{Ts: "005", FormName: "cindel", FileName: ".."},
+					b: &pb.MessageBody{Body: []byte("czczc"), Last: true},
+				},
+			},
+			wantTables: map[string]map[string]interface{}{
+				"005": {
+					"alice":  fileEntry("005/passwd", "../../etc/passwd"),
+					"bob":    fileEntry("005/_con.txt", `C:\Windows\con.txt`),
+					"cindel": fileEntry("005/file", ".."),
+				},
+			},
+			wantContent: map[string][]byte{
+				"005/passwd":   []byte("azaza"),
+				"005/_con.txt": []byte("bzbzb"),
+				"005/file":     []byte("czczc"),
+			},
+		},
+		{
+			name: "colliding file names",
+			messages: []message{
+				{
+					h: &pb.MessageHeader{Ts: "006", FormName: "alice", FileName: "first.txt", First: true},
+					b: &pb.MessageBody{Body: []byte("azaza")},
+				},
+				{
+					h: &pb.MessageHeader{Ts: "006", FormName: "bob", FileName: "dir/first.txt"},
+					b: &pb.MessageBody{Body: []byte("bzbzb")},
+				},
+				{
+					h: &pb.MessageHeader{Ts: "006", FormName: "cindel", FileName: "FIRST.TXT"},
+					b: &pb.MessageBody{Body: []byte("czczc")},
+				},
+				{
+					h: &pb.MessageHeader{Ts: "006", FormName: "david", FileName: "006.json"},
+					b: &pb.MessageBody{Body: []byte("dzdzd"), Last: true},
+				},
+			},
+			wantTables: map[string]map[string]interface{}{
+				"006": {
+					"alice":  fileEntry("006/first.txt", "first.txt"),
+					"bob":    fileEntry("006/first_1.txt", "dir/first.txt"),
+					"cindel": fileEntry("006/FIRST_2.TXT", "FIRST.TXT"),
+					"david":  fileEntry("006/006_1.json", "006.json"),
+				},
+			},
+			wantContent: map[string][]byte{
+				"006/first.txt":   []byte("azaza"),
+				"006/first_1.txt": []byte("bzbzb"),
+				"006/FIRST_2.TXT": []byte("czczc"),
+				"006/006_1.json":  []byte("dzdzd"),
+			},
+		},
+		{
+			name: "repeated fields",
+			messages: []message{
+				{
+					h: &pb.MessageHeader{Ts: "007", FormName: "attachments", FileName: "first.txt", First: true},
+					b: &pb.MessageBody{Body: []byte("azaza")},
+				},
+				{
+					h: &pb.MessageHeader{Ts: "007", FormName: "attachments", FileName: "first.txt", Part: 1},
+					b: &pb.MessageBody{Body: []byte("bzbzb")},
+				},
+				{
+					h: &pb.MessageHeader{Ts: "007", FormName: "attachments", FileName: "first.txt"},
+					b: &pb.MessageBody{Body: []byte("czczc")},
+				},
+				{
+					h: &pb.MessageHeader{Ts: "007", FormName: "attachments", FileName: "second.txt", Part: 2},
+					b: &pb.MessageBody{Body: []byte("dzdzd")},
+				},
+				{
+					h: &pb.MessageHeader{Ts: "007", FormName: "colors"},
+					b: &pb.MessageBody{Body: []byte("red")},
+				},
+				{
+					h: &pb.MessageHeader{Ts: "007", FormName: "colors", Part: 1},
+					b: &pb.MessageBody{Body: []byte("green"), Last: true},
+				},
+			},
+			wantTables: map[string]map[string]interface{}{
+				"007": {
+					"attachments":    fileEntry("007/first.txt", "first.txt"),
+					"attachments[1]": fileEntry("007/first_1.txt", "first.txt"),
+					"attachments[2]": fileEntry("007/second.txt", "second.txt"),
+					"colors":         "red",
+					"colors[1]":      "green",
+				},
+			},
+			wantContent: map[string][]byte{
+				"007/first.txt":   []byte("azazaczczc"),
+				"007/first_1.txt": []byte("bzbzb"),
+				"007/second.txt":  []byte("dzdzd"),
+			},
+		},
+		{
+			name: "repeated fields without part",
+			messages: []message{
+				{
+					h: &pb.MessageHeader{Ts: "008", FormName: "attachments", FileName: "first.txt", First: true},
+					b: &pb.MessageBody{Body: []byte("azaza")},
+				},
+				{
+					h: &pb.MessageHeader{Ts: "008", FormName: "attachments", FileName: "first.txt"},
+					b: &pb.MessageBody{Body: []byte("bzbzb")},
+				},
+				{
+					h: &pb.MessageHeader{Ts: "008", FormName: "attachments", FileName: "second.txt"},
+					b: &pb.MessageBody{Body: []byte("czczc")},
+				},
+				{
+					h: &pb.MessageHeader{Ts: "008", FormName: "attachments", FileName: "second.txt"},
+					b: &pb.MessageBody{Body: []byte("dzdzd")},
+				},
+				{
+					h: &pb.MessageHeader{Ts: "008", FormName: "colors"},
+					b: &pb.MessageBody{Body: []byte("red")},
+				},
+				{
+					h: &pb.MessageHeader{Ts: "008", FormName: "colors"},
+					b: &pb.MessageBody{Body: []byte("blue"), Last: true},
+				},
+			},
+			// values are not numbered, only file name change tells them apart
+			wantTables: map[string]map[string]interface{}{
+				"008": {
+					"attachments":    fileEntry("008/first.txt", "first.txt"),
+					"attachments[1]": fileEntry("008/second.txt", "second.txt"),
+					"colors":         "redblue",
+				},
+			},
+			wantContent: map[string][]byte{
+				"008/first.txt":  []byte("azazabzbzb"),
+				"008/second.txt": []byte("czczcdzdzd"),
+			},
+		},
+	}
+	for _, v := range tt {
+		s.Run(v.name, func() {
+			s.Require().NoError(os.RemoveAll(s.root))
+			sv, err := NewSaver(s.cfg)
+			s.Require().NoError(err)
+
+			for i, m := range v.messages {
+				s.Require().NoError(sv.Save(m.h, m.b, repo.Position{Offset: int64(i)}))
+			}
+
+			for ts, want := range v.wantTables {
+				s.Equal(want, s.readTable(s.root, ts))
+			}
+			for name, want := range v.wantContent {
+				got, err := os.ReadFile(filepath.Join(s.root, name))
+				s.Require().NoError(err)
+				s.Equal(want, got)
+			}
+			s.Empty(sv.S)
+		})
+	}
+}
+
+func (s *saverSuite) TestSaveText() {
+	hexDigest := func(data string) string {
+		sum := sha256.Sum256([]byte(data))
+		return hex.EncodeToString(sum[:])
+	}
+	tt := []struct {
+		name        string
+		limit       int64
+		chunks      []string
+		restart     int // chunks saved before restart, 0 for none
+		want        *field
+		wantContent []byte
+	}{
+		{
+			name:   "inline",
+			limit:  11,
+			chunks: []string{"lorem ", "ipsum"},
+			want:   &field{Name: "bob", Kind: KindText, Value: "lorem ipsum", Size: 11, Chunks: 2},
+		},
+		{
+			name:        "spilled",
+			limit:       8,
+			chunks:      []string{"lorem ", "ipsum ", "dolor"},
+			want:        &field{Name: "bob", Kind: KindText, Path: "001/bob.txt", Size: 17, SHA256: hexDigest("lorem ipsum dolor"), Chunks: 3},
+			wantContent: []byte("lorem ipsum dolor"),
+		},
+		{
+			name:        "spilled at once",
+			chunks:      []string{"lorem"},
+			want:        &field{Name: "bob", Kind: KindText, Path: "001/bob.txt", Size: 5, SHA256: hexDigest("lorem"), Chunks: 1},
+			wantContent: []byte("lorem"),
+		},
+		{
+			name:    "inline restored",
+			limit:   20,
+			chunks:  []string{"lorem ", "ipsum ", "dolor"},
+			restart: 2,
+			want:    &field{Name: "bob", Kind: KindText, Value: "lorem ipsum dolor", Size: 17, Chunks: 3},
+		},
+		{
+			name:        "spilled restored",
+			limit:       8,
+			chunks:      []string{"lorem ", "ipsum ", "dolor"},
+			restart:     2,
+			want:        &field{Name: "bob", Kind: KindText, Path: "001/bob.txt", Size: 17, SHA256: hexDigest("lorem ipsum dolor"), Chunks: 3},
+			wantContent: []byte("lorem ipsum dolor"),
+		},
+	}
+	for _, v := range tt {
+		s.Run(v.name, func() {
+			s.Require().NoError(os.RemoveAll(s.root))
+			s.cfg.TextInlineLimit = v.limit
+			sv, err := NewSaver(s.cfg)
+			s.Require().NoError(err)
+
+			for i, c := range v.chunks {
+				if i > 0 && i == v.restart {
+					s.Require().NoError(sv.Close())
+					sv, err = NewSaver(s.cfg)
+					s.Require().NoError(err)
+				}
+				err = sv.Save(&pb.MessageHeader{Ts: "001", FormName: "bob", First: i == 0}, &pb.MessageBody{Body: []byte(c), Last: i == len(v.chunks)-1}, repo.Position{Offset: int64(i)})
+				s.Require().NoError(err)
+			}
+
+			s.Equal([]*field{v.want}, s.readManifest(s.root, "001").Fields)
+			if v.wantContent != nil {
+				got, err := os.ReadFile(filepath.Join(s.root, "001", "bob.txt"))
+				s.Require().NoError(err)
+				s.Equal(v.wantContent, got)
+			}
+		})
+	}
+}
+
+func (s *saverSuite) TestChecksums() {
+	digest := func(data string) []byte {
+		sum := sha256.Sum256([]byte(data))
+		return sum[:]
+	}
+	hexDigest := func(data string) string {
+		return hex.EncodeToString(digest(data))
+	}
+	tt := []struct {
+		name            string
+		bodies          []*pb.MessageBody
+		restart         bool
+		wantErr         []bool
+		wantQuarantined bool
+		wantContent     []byte // nil if nothing is kept
+		wantChunks      []string
+	}{
+		{
+			name: "matching",
+			bodies: []*pb.MessageBody{
+				{Body: []byte("azaza"), ChunkSha256: digest("azaza")},
+				{Body: []byte("bzbzb"), ChunkSha256: digest("bzbzb"), Sha256: digest("azazabzbzb")},
+				{Last: true},
+			},
+			wantErr:     []bool{false, false, false},
+			wantContent: []byte("azazabzbzb"),
+			wantChunks:  []string{"azaza", "bzbzb"},
+		},
+		{
+			name: "corrupted chunk",
+			bodies: []*pb.MessageBody{
+				{Body: []byte("azaza")},
+				{Body: []byte("bzbzc"), ChunkSha256: digest("bzbzb")},
+				{Body: []byte("czczc"), ChunkSha256: digest("czczc")},
+				{Last: true},
+			},
+			wantErr:         []bool{false, false, false, false},
+			wantQuarantined: true,
+			wantContent:     []byte("azaza"),
+			wantChunks:      []string{"azaza"},
+		},
+		{
+			name: "corrupted chunk restored",
+			bodies: []*pb.MessageBody{
+				{Body: []byte("azaza")},
+				{Body: []byte("bzbzc"), ChunkSha256: digest("bzbzb")},
+				{Body: []byte("czczc"), ChunkSha256: digest("czczc")},
+				{Last: true},
+			},
+			restart:         true,
+			wantErr:         []bool{false, false, false, false},
+			wantQuarantined: true,
+			wantContent:     []byte("azaza"),
+			wantChunks:      []string{"azaza"},
+		},
+		{
+			name: "corrupted first chunk",
+			bodies: []*pb.MessageBody{
+				{Body: []byte("azazc"), ChunkSha256: digest("azaza")},
+				{Body: []byte("bzbzb")},
+				{Last: true},
+			},
+			wantErr:         []bool{false, false, false},
+			wantQuarantined: true,
+		},
+		{
+			name: "corrupted file",
+			bodies: []*pb.MessageBody{
+				{Body: []byte("azaza")},
+				{Body: []byte("bzbzb"), Sha256: digest("azazabzbzc")},
+				{Body: []byte("czczc")},
+				{Last: true},
+			},
+			wantErr:         []bool{false, false, false, false},
+			wantQuarantined: true,
+			wantContent:     []byte("azazabzbzb"),
+			wantChunks:      []string{"azaza", "bzbzb"},
+		},
+		{
+			name: "corrupted file restored",
+			bodies: []*pb.MessageBody{
+				{Body: []byte("azaza")},
+				{Body: []byte("bzbzb"), Sha256: digest("azazabzbzc")},
+				{Body: []byte("czczc")},
+				{Last: true},
+			},
+			restart:         true,
+			wantErr:         []bool{false, false, false, false},
+			wantQuarantined: true,
+			wantContent:     []byte("azazabzbzb"),
+			wantChunks:      []string{"azaza", "bzbzb"},
+		},
+	}
+	for _, v := range tt {
+		s.Run(v.name, func() {
+			s.Require().NoError(os.RemoveAll(s.root))
+			sv, err := NewSaver(s.cfg)
+			s.Require().NoError(err)
+
+			for i, b := range v.bodies {
+				if v.restart && i == 2 {
+					sv, err = NewSaver(s.cfg)
+					s.Require().NoError(err)
+				}
+				h := &pb.MessageHeader{Ts: "001", FormName: "alice", FileName: "first.txt", First: i == 0}
+				if len(b.Body) == 0 {
+					h = &pb.MessageHeader{Ts: "001"}
+				}
+				err = sv.Save(h, b, repo.Position{Offset: int64(i)})
+				if v.wantErr[i] {
+					s.Error(err)
+				} else {
+					s.NoError(err)
+				}
+			}
+			fields := s.readManifest(s.root, "001").Fields
+			s.Require().Len(fields, 1)
+			alice := fields[0]
+
+			s.Equal(v.wantQuarantined, alice.Quarantined)
+			s.Equal(KindFile, alice.Kind)
+			var wantChunks []string
+			for _, c := range v.wantChunks {
+				wantChunks = append(wantChunks, hexDigest(c))
+			}
+			s.Equal(wantChunks, alice.ChunkSHA256)
+
+			fileName := filepath.Join(s.root, "001", "first.txt")
+			if v.wantContent == nil {
+				s.Empty(alice.SHA256)
+				s.Empty(alice.Path)
+				_, err = os.Stat(fileName)
+				s.True(os.IsNotExist(err))
+				return
+			}
+			s.Equal(hexDigest(string(v.wantContent)), alice.SHA256)
+			if v.wantQuarantined {
+				s.Equal(".quarantine/001/first.txt", alice.Path)
+				_, err = os.Stat(fileName)
+				s.True(os.IsNotExist(err))
+				fileName = filepath.Join(s.root, quarantineFolder, "001", "first.txt")
+			}
+			got, err := os.ReadFile(fileName)
+			s.Require().NoError(err)
+			s.Equal(v.wantContent, got)
+		})
+	}
+}
+
+func (s *saverSuite) TestSaveConcurrent() {
+	sv, err := NewSaver(s.cfg)
+	s.Require().NoError(err)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(partition int) {
+			defer wg.Done()
+			ts := fmt.Sprintf("%03d", partition)
+			for j := 0; j < 10; j++ {
+				err := sv.Save(&pb.MessageHeader{Ts: ts, FormName: "alice", FileName: "first.txt", First: j == 0}, &pb.MessageBody{Body: []byte(ts), Last: j == 9}, repo.Position{Partition: partition, Offset: int64(j)})
+				s.NoError(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < 20; i++ {
+		ts := fmt.Sprintf("%03d", i)
+		got, err := os.ReadFile(filepath.Join(s.root, ts, "first.txt"))
+		s.Require().NoError(err)
+		s.Equal(bytes.Repeat([]byte(ts), 10), got)
+	}
+	s.Empty(sv.S)
+}
+
+func (s *saverSuite) TestSaveRedelivered() {
+	messages := []message{
+		{
+			h: &pb.MessageHeader{Ts: "001", FormName: "alice", FileName: "first.txt", First: true},
+			b: &pb.MessageBody{Body: []byte("azaza")},
+		},
+		{
+			h: &pb.MessageHeader{Ts: "001", FormName: "alice", FileName: "first.txt"},
+			b: &pb.MessageBody{Body: []byte("bzbzbz")},
+		},
+		{
+			h: &pb.MessageHeader{Ts: "001", FormName: "bob", FileName: "second.txt"},
+			b: &pb.MessageBody{Body: []byte("11111")},
+		},
+		{
+			h: &pb.MessageHeader{Ts: "001", FormName: "bob", FileName: "second.txt"},
+			b: &pb.MessageBody{Body: []byte("22222"), Last: true},
+		},
+	}
+	tt := []struct {
+		name    string
+		offsets []int64
+	}{
+		{
+			name:    "in the middle",
+			offsets: []int64{0, 1, 2, 1, 2, 3},
+		},
+		{
+			name:    "after completion",
+			offsets: []int64{0, 1, 2, 3, 2, 3},
+		},
+		{
+			name:    "whole stream",
+			offsets: []int64{0, 1, 2, 3, 0, 1, 2, 3},
+		},
+	}
+	for _, v := range tt {
+		s.Run(v.name, func() {
+			s.Require().NoError(os.RemoveAll(s.root))
+			sv, err := NewSaver(s.cfg)
+			s.Require().NoError(err)
+
+			for _, o := range v.offsets {
+				m := messages[o]
+				s.Require().NoError(sv.Save(m.h, m.b, repo.Position{Partition: 3, Offset: 10 + o}))
+			}
+
+			s.Equal(map[string]interface{}{"alice": fileEntry("001/first.txt", "first.txt"), "bob": fileEntry("001/second.txt", "second.txt")}, s.readTable(s.root, "001"))
+
+			got, err := os.ReadFile(filepath.Join(s.root, "001", "first.txt"))
+			s.Require().NoError(err)
+			s.Equal([]byte("azazabzbzbz"), got)
+
+			got, err = os.ReadFile(filepath.Join(s.root, "001", "second.txt"))
+			s.Require().NoError(err)
+			s.Equal([]byte("1111122222"), got)
+
+			s.Empty(sv.S)
+			s.Equal(map[int]int64{3: 13}, sv.W)
+		})
+	}
+}
+
+func (s *saverSuite) TestPublish() {
+	sv, err := NewSaver(s.cfg)
+	s.Require().NoError(err)
+	staging := filepath.Join(s.root, stagingFolder)
+
+	err = sv.Save(&pb.MessageHeader{Ts: "001", FormName: "alice", FileName: "first.txt", First: true}, &pb.MessageBody{Body: []byte("azaza")}, repo.Position{Offset: 0})
+	s.Require().NoError(err)
+
+	_, err = os.Stat(filepath.Join(s.root, "001"))
+	s.True(os.IsNotExist(err))
+	got, err := os.ReadFile(filepath.Join(staging, "001", "first.txt"))
+	s.Require().NoError(err)
+	s.Equal([]byte("azaza"), got)
+
+	err = sv.Save(&pb.MessageHeader{Ts: "001", FormName: "alice", FileName: "first.txt"}, &pb.MessageBody{Body: []byte("bzbzb"), Last: true}, repo.Position{Offset: 1})
+	s.Require().NoError(err)
+
+	s.Equal(map[string]interface{}{"alice": fileEntry("001/first.txt", "first.txt")}, s.readTable(s.root, "001"))
+	got, err = os.ReadFile(filepath.Join(s.root, "001", "first.txt"))
+	s.Require().NoError(err)
+	s.Equal([]byte("azazabzbzb"), got)
+
+	entries, err := os.ReadDir(staging)
+	s.Require().NoError(err)
+	s.Empty(entries)
+}
+
+func (s *saverSuite) TestPublishConflict() {
+	sv, err := NewSaver(s.cfg)
+	s.Require().NoError(err)
+	s.Require().NoError(os.MkdirAll(filepath.Join(s.root, "001"), 0777))
+
+	err = sv.Save(&pb.MessageHeader{Ts: "001", FormName: "alice", FileName: "first.txt", First: true}, &pb.MessageBody{Body: []byte("azaza"), Last: true}, repo.Position{Offset: 0})
+	s.Error(err)
+
+	entries, err := os.ReadDir(filepath.Join(s.root, "001"))
+	s.Require().NoError(err)
+	s.Empty(entries)
+	s.Equal(map[string]interface{}{"alice": fileEntry("001/first.txt", "first.txt")}, s.readTable(filepath.Join(s.root, stagingFolder), "001"))
+
+	err = sv.Save(&pb.MessageHeader{Ts: "001", FormName: "alice", FileName: "first.txt", First: true}, &pb.MessageBody{Body: []byte("azaza"), Last: true}, repo.Position{Offset: 0})
+	s.Error(err)
+	s.True(repo.IsPermanent(err))
+}
+
+// memStorage keeps objects in memory, recording order in which they are finalized
+type memStorage struct {
+	objects map[string][]byte
+	order   []string
+	aborted []string
+	fail    string // key which cannot be created
+}
+
+// memStreamer takes files streamed by saver
+type memStreamer struct {
+	*memStorage
+	abortedAll []string
+}
+
+func (m *memStreamer) AbortAll(prefix string) error {
+	m.abortedAll = append(m.abortedAll, prefix)
+	return nil
+}
+
+type memObject struct {
+	m    *memStorage
+	key  string
+	data []byte
+}
+
+func (m *memStorage) Create(key string) (storage.Object, error) {
+	if key == m.fail {
+		return nil, fmt.Errorf("unable to create %q", key)
+	}
+	return &memObject{m: m, key: key}, nil
+}
+
+func (m *memStorage) Delete(key string) error {
+	delete(m.objects, key)
+	return nil
+}
+
+func (m *memStorage) List(prefix string) ([]string, error) {
+	keys := make([]string, 0)
+	for k := range m.objects {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+func (o *memObject) WriteAt(p []byte, off int64) (int, error) {
+	if end := off + int64(len(p)); end > int64(len(o.data)) {
+		o.data = append(o.data, make([]byte, end-int64(len(o.data)))...)
+	}
+	return copy(o.data[off:], p), nil
+}
+
+func (o *memObject) Finalize() error {
+	o.m.objects[o.key] = o.data
+	o.m.order = append(o.m.order, o.key)
+	return nil
+}
+
+func (o *memObject) Abort() error {
+	o.m.aborted = append(o.m.aborted, o.key)
+	return nil
+}
+
+func (s *saverSuite) TestUpload() {
+	tt := []struct {
+		name          string
+		objects       map[string][]byte
+		fail          string
+		wantErr       bool
+		wantPermanent bool
+		wantOrder     []string
+	}{
+		{
+			name:      "uploaded",
+			objects:   map[string][]byte{},
+			wantOrder: []string{"001/first.txt", "001/001.json"},
+		},
+		{
+			name:          "already published",
+			objects:       map[string][]byte{"001/001.json": []byte("{}")},
+			wantErr:       true,
+			wantPermanent: true,
+			wantOrder:     []string{},
+		},
+		{
+			name:      "failed",
+			objects:   map[string][]byte{},
+			fail:      "001/001.json",
+			wantErr:   true,
+			wantOrder: []string{"001/first.txt"},
+		},
+	}
+	for _, v := range tt {
+		s.Run(v.name, func() {
+			s.Require().NoError(os.RemoveAll(s.root))
+			m := &memStorage{objects: v.objects, order: []string{}, fail: v.fail}
+			sv, err := newSaver(s.cfg, m)
+			s.Require().NoError(err)
+
+			err = sv.Save(&pb.MessageHeader{Ts: "001", FormName: "alice", FileName: "first.txt", First: true}, &pb.MessageBody{Body: []byte("azaza"), Last: true}, repo.Position{})
+
+			s.Equal(v.wantOrder, m.order)
+			_, serr := os.Stat(filepath.Join(s.root, stagingFolder, "001"))
+			if v.wantErr {
+				s.Error(err)
+				s.Equal(v.wantPermanent, repo.IsPermanent(err))
+				s.NoError(serr)
+				s.NotContains(m.objects, "001/first.txt")
+				return
+			}
+			s.NoError(err)
+			s.True(os.IsNotExist(serr))
+			s.Equal([]byte("azaza"), m.objects["001/first.txt"])
+			s.Contains(string(m.objects["001/001.json"]), `"path": "001/first.txt"`)
+		})
+	}
+}
+
+// TestRetry checks that message failed transiently is finished by retry without being applied twice
+func (s *saverSuite) TestRetry() {
+	first := &pb.MessageHeader{Ts: "001", FormName: "alice", FileName: "first.txt", First: true}
+	next := &pb.MessageHeader{Ts: "001", FormName: "alice", FileName: "first.txt"}
+
+	tt := []struct {
+		name string
+		fail func(*SaverStruct, *memStorage) func()
+	}{
+		{
+			name: "journaling failed",
+			fail: func(sv *SaverStruct, m *memStorage) func() {
+				ss := sv.S["001"]
+				j := ss.J
+				ss.J = &repo.FileInfo{Path: filepath.Join(s.root, "missing", "001")}
+				return func() { ss.J = j }
+			},
+		},
+		{
+			name: "publishing failed",
+			fail: func(sv *SaverStruct, m *memStorage) func() {
+				m.fail = "001/001.json"
+				return func() { m.fail = "" }
+			},
+		},
+	}
+	for _, v := range tt {
+		s.Run(v.name, func() {
+			s.Require().NoError(os.RemoveAll(s.root))
+			m := &memStorage{objects: map[string][]byte{}, order: []string{}}
+			sv, err := newSaver(s.cfg, m)
+			s.Require().NoError(err)
+
+			s.Require().NoError(sv.Save(first, &pb.MessageBody{Body: []byte("azaza")}, repo.Position{Offset: 1}))
+
+			heal := v.fail(sv, m)
+			err = sv.Save(next, &pb.MessageBody{Body: []byte("bzbzb")}, repo.Position{Offset: 2})
+			if err == nil {
+				err = sv.Save(next, &pb.MessageBody{Body: []byte("czczc"), Last: true}, repo.Position{Offset: 3})
+				s.Require().Error(err)
+				s.False(repo.IsPermanent(err))
+				heal()
+				s.Require().NoError(sv.Save(next, &pb.MessageBody{Body: []byte("czczc"), Last: true}, repo.Position{Offset: 3}))
+			} else {
+				s.False(repo.IsPermanent(err))
+				heal()
+				s.Require().NoError(sv.Save(next, &pb.MessageBody{Body: []byte("bzbzb")}, repo.Position{Offset: 2}))
+				s.Require().NoError(sv.Save(next, &pb.MessageBody{Body: []byte("czczc"), Last: true}, repo.Position{Offset: 3}))
+			}
+
+			s.Equal([]byte("azazabzbzbczczc"), m.objects["001/first.txt"])
+			s.Empty(sv.S)
+
+			// redelivered after it was finished
+			s.NoError(sv.Save(next, &pb.MessageBody{Body: []byte("czczc"), Last: true}, repo.Position{Offset: 3}))
+			s.Len(m.objects, 2)
+		})
+	}
+}
+
+func (s *saverSuite) TestStream() {
+	sum := sha256.Sum256([]byte("azazabzbzb"))
+	bad := sha256.Sum256([]byte("czczc"))
+
+	tt := []struct {
+		name        string
+		last        *pb.MessageBody
+		abandon     bool
+		wantObjects []string
+		wantAborted []string
+	}{
+		{
+			name:        "completed",
+			last:        &pb.MessageBody{Body: []byte("bzbzb"), Last: true, Sha256: sum[:]},
+			wantObjects: []string{"001/first.txt", "001/001.json"},
+			wantAborted: []string{},
+		},
+		{
+			name:        "quarantined",
+			last:        &pb.MessageBody{Body: []byte("bzbzb"), Last: true, Sha256: bad[:]},
+			wantObjects: []string{"001/001.json"},
+			wantAborted: []string{"001/first.txt"},
+		},
+		{
+			name:        "abandoned",
+			abandon:     true,
+			wantObjects: []string{},
+			wantAborted: []string{"001/first.txt"},
+		},
+	}
+	for _, v := range tt {
+		s.Run(v.name, func() {
+			s.Require().NoError(os.RemoveAll(s.root))
+			m := &memStreamer{memStorage: &memStorage{objects: map[string][]byte{}, order: []string{}, aborted: []string{}}}
+			sv, err := newSaver(s.cfg, m)
+			s.Require().NoError(err)
+
+			err = sv.Save(&pb.MessageHeader{Ts: "001", FormName: "alice", FileName: "first.txt", First: true}, &pb.MessageBody{Body: []byte("azaza")}, repo.Position{Offset: 0})
+			s.Require().NoError(err)
+			_, err = os.Stat(filepath.Join(s.root, stagingFolder, "001", "first.txt"))
+			s.True(os.IsNotExist(err))
+
+			switch {
+			case v.last != nil:
+				err = sv.Save(&pb.MessageHeader{Ts: "001", FormName: "alice", FileName: "first.txt"}, v.last, repo.Position{Offset: 1})
+				s.Require().NoError(err)
+			case v.abandon:
+				s.Require().NoError(sv.Abandon("001", false))
+			}
+
+			s.Equal(v.wantObjects, m.order)
+			s.Equal(v.wantAborted, m.aborted)
+			if v.last != nil {
+				mf := &manifest{}
+				s.Require().NoError(json.Unmarshal(m.objects["001/001.json"], mf))
+				s.Equal(v.name == "quarantined", mf.Fields[0].Quarantined)
+			}
+			if v.name == "completed" {
+				s.Equal([]byte("azazabzbzb"), m.objects["001/first.txt"])
+			}
+		})
+	}
+}
+
+func (s *saverSuite) TestStreamRestarted() {
+	m := &memStreamer{memStorage: &memStorage{objects: map[string][]byte{}, order: []string{}, aborted: []string{}}}
+	sv, err := newSaver(s.cfg, m)
+	s.Require().NoError(err)
+
+	messages := []message{
+		{
+			h: &pb.MessageHeader{Ts: "001", FormName: "alice", FileName: "first.txt", First: true},
+			b: &pb.MessageBody{Body: []byte("azaza")},
+		},
+		{
+			h: &pb.MessageHeader{Ts: "002", FormName: "bob", FileName: "second.txt", First: true},
+			b: &pb.MessageBody{Body: []byte("11111"), Last: true},
+		},
+		{
+			h: &pb.MessageHeader{Ts: "001", FormName: "alice", FileName: "first.txt"},
+			b: &pb.MessageBody{Body: []byte("bzbzb")},
+		},
+		{
+			h: &pb.MessageHeader{Ts: "001", FormName: "alice", FileName: "first.txt"},
+			b: &pb.MessageBody{Body: []byte("czczc"), Last: true},
+		},
+	}
+	for o := int64(0); o < 3; o++ {
+		s.Require().NoError(sv.Save(messages[o].h, messages[o].b, repo.Position{Offset: o}))
+		// 001 is not published, nothing may be committed
+		s.Equal(int64(-1), sv.Committable(repo.Position{Offset: o}))
+	}
+	s.Require().NoError(sv.Close())
+	s.Empty(m.aborted)
+
+	// killed before messages lost are redelivered
+	sv, err = newSaver(s.cfg, m)
+	s.Require().NoError(err)
+	s.Require().NoError(sv.Close())
+
+	sv, err = newSaver(s.cfg, m)
+	s.Require().NoError(err)
+	s.Equal([]string{"001/"}, m.abortedAll)
+	s.Empty(sv.S)
+	s.Equal(map[int]int64{0: 2}, sv.W)
+	s.Equal(map[repo.Position]bool{{Offset: 0}: true, {Offset: 2}: true}, sv.U)
+	s.Equal(int64(0), sv.Resume(0))
+	s.Equal(int64(-1), sv.Resume(1))
+	_, err = os.Stat(filepath.Join(s.root, stagingFolder, "001"))
+	s.True(os.IsNotExist(err))
+
+	// redelivered from first offset not committed
+	for o, v := range messages {
+		s.Require().NoError(sv.Save(v.h, v.b, repo.Position{Offset: int64(o)}))
+	}
+	s.Equal(int64(3), sv.Committable(repo.Position{Offset: 3}))
+	s.Equal([]byte("azazabzbzbczczc"), m.objects["001/first.txt"])
+	s.Equal([]byte("11111"), m.objects["002/second.txt"])
+	s.Empty(sv.U)
+
+	sv, err = newSaver(s.cfg, m)
+	s.Require().NoError(err)
+	s.Empty(sv.U)
+	s.Equal(map[int]int64{0: 3}, sv.W)
+	s.Equal(int64(4), sv.Resume(0))
+}
+
+func (s *saverSuite) TestManifest() {
+	sv, err := NewSaver(s.cfg)
+	s.Require().NoError(err)
+	start := time.Now()
+
+	messages := []message{
+		{
+			h: &pb.MessageHeader{Ts: "001", FormName: "bob", FileName: "picture", First: true},
+			b: &pb.MessageBody{Body: []byte("\x89PNG\r\n\x1a\n")},
+		},
+		{
+			h: &pb.MessageHeader{Ts: "001", FormName: "alice", FileName: "first.txt"},
+			b: &pb.MessageBody{Body: []byte("azaza")},
+		},
+		{
+			h: &pb.MessageHeader{Ts: "001", FormName: "cindel"},
+			b: &pb.MessageBody{Body: []byte("1111")},
+		},
+		{
+			h: &pb.MessageHeader{Ts: "001", FormName: "alice", FileName: "first.txt"},
+			b: &pb.MessageBody{Body: []byte("bzbzb"), Last: true},
+		},
+	}
+	for i, m := range messages {
+		s.Require().NoError(sv.Save(m.h, m.b, repo.Position{Offset: int64(i)}))
+	}
+	got := s.readManifest(s.root, "001")
+
+	s.Equal(ManifestVersion, got.Version)
+	s.Equal("001", got.Ts)
+	s.False(got.Received.Before(start.Truncate(time.Second)))
+	s.Require().NotNil(got.Completed)
+	s.False(got.Completed.Before(got.Received))
+	s.Equal([]*field{
+		{
+			Name:        "bob",
+			Kind:        KindFile,
+			FileName:    "picture",
+			Path:        "001/picture",
+			Size:        8,
+			SHA256:      "4c4b6a3be1314ab86138bef4314dde022e600960d8689a2c8f8631802d20dab6",
+			ChunkSHA256: []string{"4c4b6a3be1314ab86138bef4314dde022e600960d8689a2c8f8631802d20dab6"},
+			ContentType: "image/png",
+			Chunks:      1,
+		},
+		{
+			Name:        "alice",
+			Kind:        KindFile,
+			FileName:    "first.txt",
+			Path:        "001/first.txt",
+			Size:        10,
+			SHA256:      "f4826ed4d2b1518ce4b43e5f91b00fcc7caf84ea5b1cd617a5e8a51f7410a5ed",
+			ChunkSHA256: []string{"734b99ad6f5f41430fd0593fc2467ff442c2fd482f3aea79082bc94543029033", "bfa484853e397c42a547472e0a01f927b3673771a4fcdc7a14bf3ac5e1ef4bd6"},
+			ContentType: "text/plain; charset=utf-8",
+			Chunks:      2,
+		},
+		{
+			Name:   "cindel",
+			Kind:   KindText,
+			Value:  "1111",
+			Size:   4,
+			Chunks: 1,
+		},
+	}, got.Fields)
+}
+
+func (s *saverSuite) TestRestore() {
+	journal := filepath.Join(s.root, journalFolder, "001")
+	staged := filepath.Join(s.root, stagingFolder, "001", "first.txt")
+	appendTo := func(fileName, data string) {
+		f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND, 0666)
+		s.Require().NoError(err)
+		defer f.Close()
+		_, err = f.WriteString(data)
+		s.Require().NoError(err)
+	}
+	tt := []struct {
+		name   string
+		crash  func(sv *SaverStruct)
+		wantW  map[int]int64
+		resume []int64
+	}{
+		{
+			name:   "killed",
+			crash:  func(sv *SaverStruct) {},
+			wantW:  map[int]int64{0: 2},
+			resume: []int64{2, 3},
+		},
+		{
+			name:   "closed",
+			crash:  func(sv *SaverStruct) { s.Require().NoError(sv.Close()) },
+			wantW:  map[int]int64{0: 2},
+			resume: []int64{3},
+		},
+		{
+			name:   "killed while writing chunk",
+			crash:  func(sv *SaverStruct) { appendTo(staged, "garbage") },
+			wantW:  map[int]int64{0: 2},
+			resume: []int64{2, 3},
+		},
+		{
+			name: "killed while journaling",
+			crash: func(sv *SaverStruct) {
+				appendTo(staged, "czczc")
+				appendTo(journal, `{"partition":0,"offset":3,"formName":"ali`)
+			},
+			wantW:  map[int]int64{0: 2},
+			resume: []int64{3},
+		},
+	}
+	messages := []message{
+		{
+			h: &pb.MessageHeader{Ts: "001", FormName: "alice", FileName: "first.txt", First: true},
+			b: &pb.MessageBody{Body: []byte("azaza")},
+		},
+		{
+			h: &pb.MessageHeader{Ts: "001", FormName: "alice", FileName: "first.txt"},
+			b: &pb.MessageBody{Body: []byte("bzbzb")},
+		},
+		{
+			h: &pb.MessageHeader{Ts: "001", FormName: "bob"},
+			b: &pb.MessageBody{Body: []byte("1111")},
+		},
+		{
+			h: &pb.MessageHeader{Ts: "001", FormName: "alice", FileName: "first.txt"},
+			b: &pb.MessageBody{Body: []byte("czczc"), Last: true},
+		},
+	}
+	for _, v := range tt {
+		s.Run(v.name, func() {
+			s.Require().NoError(os.RemoveAll(s.root))
+			sv, err := NewSaver(s.cfg)
+			s.Require().NoError(err)
+
+			for o := int64(0); o < 3; o++ {
+				s.Require().NoError(sv.Save(messages[o].h, messages[o].b, repo.Position{Offset: o}))
+			}
+			v.crash(sv)
+
+			sv, err = NewSaver(s.cfg)
+			s.Require().NoError(err)
+			s.Equal([]string{"001"}, sv.Pending())
+			s.Equal(v.wantW, sv.W)
+
+			for _, o := range v.resume {
+				s.Require().NoError(sv.Save(messages[o].h, messages[o].b, repo.Position{Offset: o}))
+			}
+
+			s.Equal(map[string]interface{}{"alice": fileEntry("001/first.txt", "first.txt"), "bob": "1111"}, s.readTable(s.root, "001"))
+			got, err := os.ReadFile(filepath.Join(s.root, "001", "first.txt"))
+			s.Require().NoError(err)
+			s.Equal([]byte("azazabzbzbczczc"), got)
+
+			alice := s.readManifest(s.root, "001").Fields[0]
+			s.Equal(int64(15), alice.Size)
+			s.Equal(3, alice.Chunks)
+			s.Equal("2f6a5a5c10f542176071e3de8b07038438cddce09b9a2f3d488f16bcefe7299b", alice.SHA256)
+
+			_, err = os.Stat(journal)
+			s.True(os.IsNotExist(err))
+			s.Empty(sv.S)
+
+			sv, err = NewSaver(s.cfg)
+			s.Require().NoError(err)
+			s.Empty(sv.Pending())
+			s.Equal(map[int]int64{0: 3}, sv.W)
+			s.NoError(sv.Save(messages[3].h, messages[3].b, repo.Position{Offset: 3}))
+		})
+	}
+}
+
+func (s *saverSuite) TestRestoreCompleted() {
+	sv, err := NewSaver(s.cfg)
+	s.Require().NoError(err)
+
+	err = sv.Save(&pb.MessageHeader{Ts: "001", FormName: "alice", FileName: "first.txt", First: true}, &pb.MessageBody{Body: []byte("azaza")}, repo.Position{Partition: 1, Offset: 7})
+	s.Require().NoError(err)
+	s.Require().NoError(sv.Close())
+
+	// killed after last record is journaled but before submission is published
+	f, err := os.OpenFile(filepath.Join(s.root, journalFolder, "001"), os.O_WRONLY|os.O_APPEND, 0666)
+	s.Require().NoError(err)
+	_, err = f.WriteString(`{"partition":1,"offset":8,"last":true}` + "\n")
+	s.Require().NoError(err)
+	s.Require().NoError(f.Close())
+
+	sv, err = NewSaver(s.cfg)
+	s.Require().NoError(err)
+
+	s.Empty(sv.Pending())
+	s.Equal(map[int]int64{1: 8}, sv.W)
+	s.Equal(map[string]interface{}{"alice": fileEntry("001/first.txt", "first.txt")}, s.readTable(s.root, "001"))
+	_, err = os.Stat(filepath.Join(s.root, journalFolder, "001"))
+	s.True(os.IsNotExist(err))
+}
+
+func (s *saverSuite) TestRestoreRenumbered() {
+	sv, err := NewSaver(s.cfg)
+	s.Require().NoError(err)
+
+	err = sv.Save(&pb.MessageHeader{Ts: "001", FormName: "attachments", FileName: "first.txt", First: true}, &pb.MessageBody{Body: []byte("azaza")}, repo.Position{Offset: 0})
+	s.Require().NoError(err)
+	err = sv.Save(&pb.MessageHeader{Ts: "001", FormName: "attachments", FileName: "second.txt"}, &pb.MessageBody{Body: []byte("bzbzb")}, repo.Position{Offset: 1})
+	s.Require().NoError(err)
+	s.Require().NoError(sv.Close())
+
+	sv, err = NewSaver(s.cfg)
+	s.Require().NoError(err)
+
+	err = sv.Save(&pb.MessageHeader{Ts: "001", FormName: "attachments", FileName: "second.txt"}, &pb.MessageBody{Body: []byte("czczc"), Last: true}, repo.Position{Offset: 2})
+	s.Require().NoError(err)
+
+	s.Equal(map[string]interface{}{
+		"attachments":    fileEntry("001/first.txt", "first.txt"),
+		"attachments[1]": fileEntry("001/second.txt", "second.txt"),
+	}, s.readTable(s.root, "001"))
+	got, err := os.ReadFile(filepath.Join(s.root, "001", "second.txt"))
+	s.Require().NoError(err)
+	s.Equal([]byte("bzbzbczczc"), got)
+}
+
+func (s *saverSuite) TestReject() {
+	sv, err := NewSaver(s.cfg)
+	s.Require().NoError(err)
+
+	first := &pb.MessageHeader{Ts: "001", FormName: "alice", FileName: "first.txt", First: true}
+	next := &pb.MessageHeader{Ts: "001", FormName: "alice", FileName: "first.txt"}
+
+	s.Require().NoError(sv.Save(first, &pb.MessageBody{Body: []byte("azaza")}, repo.Position{Offset: 0}))
+	// message at offset 1 is given up
+	s.Require().NoError(sv.Reject("001", false))
+	s.Empty(sv.S)
+	_, err = os.Stat(filepath.Join(s.root, abandonedFolder, "001", "first.txt"))
+	s.NoError(err)
+
+	err = sv.Save(next, &pb.MessageBody{Body: []byte("czczc")}, repo.Position{Offset: 2})
+	s.Error(err)
+	s.True(repo.IsPermanent(err))
+
+	sv, err = NewSaver(s.cfg)
+	s.Require().NoError(err)
+
+	err = sv.Save(next, &pb.MessageBody{Body: []byte("dzdzd"), Last: true}, repo.Position{Offset: 3})
+	s.Error(err)
+	s.True(repo.IsPermanent(err))
+	s.Empty(sv.S)
+	_, err = os.Stat(filepath.Join(s.root, "001"))
+	s.True(os.IsNotExist(err))
+}
+
+func (s *saverSuite) TestGivenUp() {
+	sv, err := NewSaver(s.cfg)
+	s.Require().NoError(err)
+
+	rejectedName := filepath.Join(s.root, journalFolder, rejectedFile)
+
+	s.Require().NoError(sv.Reject("001", false))
+	s.FileExists(rejectedName)
+
+	// given up already, nothing is rewritten
+	s.Require().NoError(os.Remove(rejectedName))
+	s.Require().NoError(sv.Reject("001", false))
+	s.NoFileExists(rejectedName)
+
+	sv.X["001"] = time.Now().Add(-time.Hour * 2)
+	s.Require().NoError(sv.Reject("002", false))
+	s.NoError(sv.Purge(time.Hour))
+
+	sv, err = NewSaver(s.cfg)
+	s.Require().NoError(err)
+	s.NotContains(sv.X, "001")
+	s.Contains(sv.X, "002")
+	s.NoError(sv.Save(&pb.MessageHeader{Ts: "001", FormName: "alice", FileName: "first.txt", First: true}, &pb.MessageBody{Body: []byte("azaza")}, repo.Position{}))
+
+	// the oldest are forgotten first
+	old := time.Now().Add(-time.Hour)
+	for i := 0; len(sv.X) < maxGivenUp; i++ {
+		sv.X[fmt.Sprintf("1%05d", i)] = old.Add(time.Duration(i))
+	}
+	s.Require().NoError(sv.Reject("003", false))
+	s.Len(sv.X, maxGivenUp)
+	s.NotContains(sv.X, "100000")
+	s.Contains(sv.X, "003")
+}
+
+func (s *saverSuite) TestSkip() {
+	sv, err := NewSaver(s.cfg)
+	s.Require().NoError(err)
+
+	s.Require().NoError(sv.Save(&pb.MessageHeader{Ts: "001", FormName: "alice", First: true}, &pb.MessageBody{Body: []byte("azaza"), Last: true}, repo.Position{Offset: 0}))
+	// dead-lettered
+	s.Require().NoError(sv.Skip(repo.Position{Offset: 1}))
+	s.Equal(int64(2), sv.Resume(0))
+	s.Require().NoError(sv.Skip(repo.Position{Offset: 0}))
+	s.Equal(int64(2), sv.Resume(0))
+
+	sv, err = NewSaver(s.cfg)
+	s.Require().NoError(err)
+	s.Equal(int64(2), sv.Resume(0))
+}
+
+func (s *saverSuite) TestAbandon() {
+	tt := []struct {
+		name          string
+		remove        bool
+		last          bool
+		wantFolder    bool
+		wantAbandoned bool
+		wantRejected  bool
+	}{
+		{
+			name:          "incomplete moved",
+			wantAbandoned: true,
+			wantRejected:  true,
+		},
+		{
+			name:         "incomplete removed",
+			remove:       true,
+			wantRejected: true,
+		},
+		{
+			name:       "completed",
+			remove:     true,
+			last:       true,
+			wantFolder: true,
+		},
+	}
+	for _, v := range tt {
+		s.Run(v.name, func() {
+			s.Require().NoError(os.RemoveAll(s.root))
+			sv, err := NewSaver(s.cfg)
+			s.Require().NoError(err)
+
+			err = sv.Save(&pb.MessageHeader{Ts: "001", FormName: "alice", FileName: "first.txt", First: true}, &pb.MessageBody{Body: []byte("azaza"), Last: v.last}, repo.Position{})
+			s.Require().NoError(err)
+
+			s.NoError(sv.Abandon("001", v.remove))
+
+			_, err = os.Stat(filepath.Join(s.root, "001"))
+			s.Equal(v.wantFolder, err == nil)
+			got, err := os.ReadFile(filepath.Join(s.root, abandonedFolder, "001", "first.txt"))
+			s.Equal(v.wantAbandoned, err == nil)
+			if v.wantAbandoned {
+				s.Equal([]byte("azaza"), got)
+			}
+			s.Empty(sv.S)
+
+			// late chunks do not start submission anew
+			err = sv.Save(&pb.MessageHeader{Ts: "001", FormName: "alice", FileName: "first.txt"}, &pb.MessageBody{Body: []byte("bzbzb")}, repo.Position{Offset: 1})
+			s.Equal(v.wantRejected, repo.IsPermanent(err))
+			if v.wantRejected {
+				s.Empty(sv.S)
+				_, err = os.Stat(filepath.Join(s.root, stagingFolder, "001"))
+				s.True(os.IsNotExist(err))
+			}
+		})
+	}
+}
+
+func (s *saverSuite) TestPurge() {
+	sv, err := NewSaver(s.cfg)
+	s.Require().NoError(err)
+
+	for _, ts := range []string{"001", "002"} {
+		err = sv.Save(&pb.MessageHeader{Ts: ts, FormName: "alice", FileName: "first.txt", First: true}, &pb.MessageBody{Body: []byte("azaza")}, repo.Position{Partition: 1, Offset: int64(len(sv.W))})
+		s.Require().NoError(err)
+		s.Require().NoError(sv.Abandon(ts, false))
+	}
+	old := time.Now().Add(-time.Hour * 2)
+	s.Require().NoError(os.Chtimes(filepath.Join(s.root, abandonedFolder, "001"), old, old))
+
+	s.NoError(sv.Purge(time.Hour))
+
+	_, err = os.Stat(filepath.Join(s.root, abandonedFolder, "001"))
+	s.True(os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(s.root, abandonedFolder, "002"))
+	s.NoError(err)
+}
+
+func (s *saverSuite) TestDurability() {
+	fsyncs := make(map[string]int64)
+	for _, policy := range []string{config.FsyncNone, config.FsyncClose, config.FsyncChunk} {
+		s.Require().NoError(os.RemoveAll(s.root))
+		s.cfg.Fsync = policy
+		sv, err := NewSaver(s.cfg)
+		s.Require().NoError(err)
+		before := metrics.Fsyncs.Value()
+
+		for i, b := range []*pb.MessageBody{{Body: []byte("azaza")}, {Body: []byte("bzbzb")}, {Last: true}} {
+			err = sv.Save(&pb.MessageHeader{Ts: "001", FormName: "alice", FileName: "first.txt", First: i == 0}, b, repo.Position{Offset: int64(i)})
+			s.Require().NoError(err)
+		}
+		fsyncs[policy] = metrics.Fsyncs.Value() - before
+
+		got, err := os.ReadFile(filepath.Join(s.root, "001", "first.txt"))
+		s.Require().NoError(err)
+		s.Equal([]byte("azazabzbzb"), got)
+		s.Equal(policy, metrics.FsyncPolicy.Value())
+	}
+	s.Zero(fsyncs[config.FsyncNone])
+	s.Positive(fsyncs[config.FsyncClose])
+	s.Greater(fsyncs[config.FsyncChunk], fsyncs[config.FsyncClose])
+}
+
+func (s *saverSuite) TestDurabilityPeriodic() {
+	s.cfg.Fsync, s.cfg.FsyncInterval = config.FsyncPeriodic, time.Millisecond*10
+	sv, err := NewSaver(s.cfg)
+	s.Require().NoError(err)
+	defer sv.Close()
+
+	before := metrics.Fsyncs.Value()
+	err = sv.Save(&pb.MessageHeader{Ts: "001", FormName: "alice", FileName: "first.txt", First: true}, &pb.MessageBody{Body: []byte("azaza")}, repo.Position{})
+	s.Require().NoError(err)
+
+	isDirty := func() bool {
+		ss := sv.S["001"]
+		ss.l.Lock()
+		defer ss.l.Unlock()
+		return ss.dirty
+	}
+	s.Eventually(func() bool { return !isDirty() }, time.Second, time.Millisecond*5)
+	s.Greater(metrics.Fsyncs.Value(), before)
+}
+
+func (s *saverSuite) TestHandleCache() {
+	s.cfg.MaxOpenFiles = 2
+	sv, err := NewSaver(s.cfg)
+	s.Require().NoError(err)
+	defer sv.Close()
+
+	before := metrics.HandleEvictions.Value()
+	tss := []string{"001", "002", "003"}
+	for i, chunk := range []string{"azaza", "bzbzb", "czczc"} {
+		for j, ts := range tss {
+			h := &pb.MessageHeader{Ts: ts, FormName: "alice", FileName: "first.txt", First: i == 0}
+			b := &pb.MessageBody{Body: []byte(chunk), Last: i == 2}
+			err = sv.Save(h, b, repo.Position{Partition: j, Offset: int64(i)})
+			s.Require().NoError(err)
+			s.LessOrEqual(sv.H.lru.Len(), 2)
+		}
+	}
+	s.Greater(metrics.HandleEvictions.Value(), before)
+	s.Zero(sv.H.lru.Len())
+
+	sum := sha256.Sum256([]byte("azazabzbzbczczc"))
+	for _, ts := range tss {
+		got, err := os.ReadFile(filepath.Join(s.root, ts, "first.txt"))
+		s.Require().NoError(err)
+		s.Equal([]byte("azazabzbzbczczc"), got)
+		s.Equal(hex.EncodeToString(sum[:]), s.readManifest(s.root, ts).Fields[0].SHA256)
+	}
+}
+
+func (s *saverSuite) TestClose() {
+	sv, err := NewSaver(s.cfg)
+	s.Require().NoError(err)
+
+	err = sv.Save(&pb.MessageHeader{Ts: "001", FormName: "alice", FileName: "first.txt", First: true}, &pb.MessageBody{Body: []byte("azaza")}, repo.Position{})
+	s.Require().NoError(err)
+
+	s.NoError(sv.Close())
+
+	staging := filepath.Join(s.root, stagingFolder)
+	s.Equal(map[string]interface{}{"alice": fileEntry("001/first.txt", "first.txt")}, s.readTable(staging, "001"))
+
+	_, err = os.Stat(filepath.Join(s.root, "001"))
+	s.True(os.IsNotExist(err))
+	got, err := os.ReadFile(filepath.Join(staging, "001", "first.txt"))
+	s.Require().NoError(err)
+	s.Equal([]byte("azaza"), got)
+	s.Empty(sv.S)
+
+	err = sv.Save(&pb.MessageHeader{Ts: "001", FormName: "alice", FileName: "first.txt"}, &pb.MessageBody{Body: []byte("bzbzb")}, repo.Position{Offset: 1})
+	s.Error(err)
+}
+
+func (s *saverSuite) TestSaveDangerousTS() {
+	sv, err := NewSaver(s.cfg)
+	s.Require().NoError(err)
+
+	for i, ts := range []string{"", "..", "../001", ".abandoned", "001/002"} {
+		err = sv.Save(&pb.MessageHeader{Ts: ts, FormName: "alice", FileName: "first.txt", First: true}, &pb.MessageBody{Body: []byte("azaza"), Last: true}, repo.Position{Offset: int64(i)})
+		s.Error(err)
+		s.True(repo.IsPermanent(err))
+	}
+	entries, err := os.ReadDir(s.root)
+	s.Require().NoError(err)
+	s.Empty(entries)
+	s.Empty(sv.S)
+}
@@ -0,0 +1,317 @@
+package saver
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	json "github.com/goccy/go-json"
+	"github.com/vynovikov/highLoadSaver/internal/adapters/driven/storage"
+	"github.com/vynovikov/highLoadSaver/internal/adapters/driver/rpc/pb"
+	"github.com/vynovikov/highLoadSaver/internal/repo"
+)
+
+// session holds state of a single form submission
+type session struct {
+	Ts   string
+	Path string                  // staging folder of submission
+	F    map[part]*repo.FileInfo // open files keyed by field part
+	M    *manifest               // submission manifest
+	I    map[part]*field         // manifest fields keyed by field part
+	V    map[part]part           // parts values are renumbered to, keyed by part sent, for parser not numbering values
+	N    map[string]bool         // lower-cased names of files in submission folder
+	J    *repo.FileInfo          // journal of applied messages
+	H    *handleCache            // keeps files and journal open
+	D    storage.Driver          // files are streamed to it instead of staging folder, nil if they are staged
+	O    map[part]*stream        // streamed files keyed by field part
+	P    *progress               // message applied by failed attempt, nil if there is none
+	done bool
+	// fsync is durability policy, dirty session has data not flushed to disk yet
+	fsync string
+	dirty bool
+	l     sync.Mutex
+}
+
+func newSession(ts, path, fsync string, h *handleCache, d storage.Driver) *session {
+	return &session{
+		Ts:    ts,
+		Path:  path,
+		H:     h,
+		D:     d,
+		fsync: fsync,
+		F:     make(map[part]*repo.FileInfo),
+		O:     make(map[part]*stream),
+		M:     newManifest(ts, time.Now()),
+		I:     make(map[part]*field),
+		V:     make(map[part]part),
+		N:     map[string]bool{strings.ToLower(ts + ".json"): true},
+	}
+}
+
+// stream is file of part written straight to storage
+type stream struct {
+	o    storage.Object
+	key  string
+	size int64
+}
+
+// progress tracks message at position p that is applied to session but not finished yet
+type progress struct {
+	p         repo.Position
+	r         record
+	journaled bool
+	published bool
+}
+
+// part identifies value of form field, repeated field has as many parts as values
+type part struct {
+	FormName string
+	Part     uint32
+}
+
+// headerPart returns part chunk described by h belongs to. Values of repeated field are told apart by part sent.
+// Chunk carrying another file name than file of its part starts new value, which is numbered after values of field
+// known so far, and following chunks sent under the same part go to it as well. Other chunks are appended to their part
+func (ss *session) headerPart(h *pb.MessageHeader) part {
+	sent := part{FormName: h.FormName, Part: h.Part}
+	p, ok := ss.V[sent]
+	if !ok {
+		p = sent
+	}
+	f, ok := ss.I[p]
+	if !ok || f.Chunks == 0 && !f.Quarantined {
+		return p
+	}
+	if len(h.FileName) == 0 || f.Kind != KindFile || f.FileName == h.FileName {
+		return p
+	}
+	for q := range ss.I {
+		if q.FormName == p.FormName && q.Part > p.Part {
+			p.Part = q.Part
+		}
+	}
+	p.Part++
+	ss.V[sent] = p
+
+	return p
+}
+
+// storedName picks a safe name for file sent as fileName, unique within submission folder.
+// Names are compared case-insensitively, so that files do not clash on case-insensitive filesystems either
+func (ss *session) storedName(fileName string) string {
+	name := repo.SanitizeFileName(fileName)
+
+	stored := name
+	for i := 1; ss.N[strings.ToLower(stored)]; i++ {
+		stored = repo.NumberedName(name, i)
+	}
+	ss.N[strings.ToLower(stored)] = true
+
+	return stored
+}
+
+func (ss *session) getFileForMessageSaving(p part, name string) (*repo.FileInfo, error) {
+	var (
+		f        *os.File
+		err      error
+		fileName string
+	)
+	if FI, ok := ss.F[p]; ok {
+		return FI, nil
+	}
+	fileName = filepath.Join(ss.Path, ss.storedName(name))
+
+	f, err = os.Create(fileName)
+	if err != nil {
+		return &repo.FileInfo{}, fmt.Errorf("in saver.getFileForMessageSaving unable to create file %q: %v", fileName, err)
+	}
+	if durable(ss.fsync, atChunk) {
+		err = storage.SyncDir(ss.Path)
+		if err != nil {
+			f.Close()
+			return &repo.FileInfo{}, err
+		}
+	}
+	FI := repo.NewFileInfo(f, 0)
+	ss.F[p] = FI
+
+	return FI, nil
+}
+
+func (ss *session) getFileForTableSaving() (*repo.FileInfo, error) {
+	var (
+		f        *os.File
+		err      error
+		fileName string
+	)
+	fileName = filepath.Join(ss.Path, ss.Ts+".json")
+
+	f, err = os.Create(fileName)
+	if err != nil {
+		return &repo.FileInfo{}, fmt.Errorf("in saver.getFileForTableSaving unable to create file %q: %v", fileName, err)
+	}
+
+	return repo.NewFileInfo(f, 0), nil
+}
+
+// saveToFile appends chunk to file of part p, creating it under name on first use.
+// It returns path of the file relative to results folder
+func (ss *session) saveToFile(p part, name string, chunk []byte) (string, error) {
+	if ss.D != nil {
+		return ss.saveToStream(p, name, chunk)
+	}
+	FI, err := ss.getFileForMessageSaving(p, name)
+	if err != nil {
+		return "", err
+	}
+	f, err := ss.H.acquire(FI, os.O_WRONLY)
+	if err != nil {
+		return "", err
+	}
+	defer ss.H.release(FI)
+
+	n, err := f.WriteAt(chunk, FI.O)
+	if err != nil {
+		return "", fmt.Errorf("in saver.saveToFile unable to write to file %q: %v", FI.Path, err)
+	}
+	if durable(ss.fsync, atChunk) {
+		err = storage.SyncFile(f)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		ss.dirty = true
+	}
+	k := int64(n)
+	FI.AddOffset(k)
+
+	return ss.Ts + "/" + filepath.Base(FI.Path), nil
+}
+
+// saveText appends chunk to value of text part p.
+// Value growing longer than limit is moved to file, where following chunks go as well
+func (ss *session) saveText(p part, chunk []byte, limit int64) error {
+	f := ss.field(p)
+	_, _, spilled := ss.stored(p)
+
+	if !spilled && int64(len(f.Value)+len(chunk)) <= limit {
+		f.addText(chunk, "")
+		return nil
+	}
+	data := chunk
+	if !spilled {
+		data = append([]byte(f.Value), chunk...)
+	}
+	filePath, err := ss.saveToFile(p, p.FormName+".txt", data)
+	if err != nil {
+		return err
+	}
+	f.addText(chunk, filePath)
+
+	return nil
+}
+
+// saveToStream appends chunk to object of part p, starting it under name on first use.
+// It returns key of the object
+func (ss *session) saveToStream(p part, name string, chunk []byte) (string, error) {
+	st, ok := ss.O[p]
+	if !ok {
+		key := ss.Ts + "/" + ss.storedName(name)
+		o, err := ss.D.Create(key)
+		if err != nil {
+			return "", err
+		}
+		st = &stream{o: o, key: key}
+		ss.O[p] = st
+	}
+	n, err := st.o.WriteAt(chunk, st.size)
+	if err != nil {
+		return "", err
+	}
+	st.size += int64(n)
+
+	return st.key, nil
+}
+
+// stored returns name and size of file of part p, ok is false if part has no open file
+func (ss *session) stored(p part) (name string, size int64, ok bool) {
+	if FI, ok := ss.F[p]; ok {
+		return filepath.Base(FI.Path), FI.O, true
+	}
+	if st, ok := ss.O[p]; ok {
+		return path.Base(st.key), st.size, true
+	}
+	return "", 0, false
+}
+
+func (ss *session) saveToTable() error {
+	FI, err := ss.getFileForTableSaving()
+	if err != nil {
+		return err
+	}
+	defer FI.F.Close()
+	fileName := ss.Ts + "/" + ss.Ts + ".json"
+
+	JSONed, err := json.MarshalIndent(ss.M, "", "  ")
+	if err != nil {
+		return fmt.Errorf("in saver.saveToTable unable to marshal manifest of %q: %v", ss.Ts, err)
+	}
+	_, err = FI.F.Write(JSONed)
+	if err != nil {
+		return fmt.Errorf("in saver.saveToTable unable to write to file %q: %v", fileName, err)
+	}
+	if !durable(ss.fsync, atClose) {
+		return nil
+	}
+	err = storage.SyncFile(FI.F)
+	if err != nil {
+		return err
+	}
+	return storage.SyncDir(ss.Path)
+}
+
+// closeFiles closes open files of session, flushing them first if policy requires it.
+// Streamed files are finalized, so that they appear in storage
+func (ss *session) closeFiles() []error {
+	errs := make([]error, 0, 15)
+	if durable(ss.fsync, atClose) {
+		if err := ss.flush(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, v := range ss.F {
+		err := ss.H.remove(v)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	ss.F = make(map[part]*repo.FileInfo)
+
+	for p, st := range ss.O {
+		err := st.o.Finalize()
+		if err != nil {
+			// kept, so that it is finalized again by retry
+			errs = append(errs, err)
+			continue
+		}
+		delete(ss.O, p)
+	}
+	return errs
+}
+
+// abortStreams discards streamed files of unfinished submission
+func (ss *session) abortStreams() []error {
+	errs := make([]error, 0, len(ss.O))
+	for _, st := range ss.O {
+		err := st.o.Abort()
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	ss.O = make(map[part]*stream)
+	return errs
+}
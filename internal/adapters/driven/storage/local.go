@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/vynovikov/highLoadSaver/internal/metrics"
+	"github.com/vynovikov/highLoadSaver/internal/repo"
+)
+
+// LocalStruct keeps objects as files under Path, key folders being subfolders.
+// Objects are visible while they are being written
+type LocalStruct struct {
+	Path string
+	Sync bool // flush files and folders to disk when they are finalized
+}
+
+func NewLocal(path string, sync bool) *LocalStruct {
+	return &LocalStruct{Path: path, Sync: sync}
+}
+
+type localObject struct {
+	f    *os.File
+	sync bool
+}
+
+// fileName returns file of key, rejecting keys which point outside of Path
+func (l *LocalStruct) fileName(key string) (string, error) {
+	name := filepath.FromSlash(key)
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("in storage.fileName key %q is not local", key)
+	}
+	return filepath.Join(l.Path, name), nil
+}
+
+func (l *LocalStruct) Create(key string) (Object, error) {
+	fileName, err := l.fileName(key)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(filepath.Dir(fileName), 0777)
+	if err != nil {
+		return nil, fmt.Errorf("in storage.Create unable to create folder for %q: %v", key, err)
+	}
+	f, err := os.Create(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("in storage.Create unable to create file %q: %v", fileName, err)
+	}
+	return &localObject{f: f, sync: l.Sync}, nil
+}
+
+func (o *localObject) WriteAt(p []byte, off int64) (int, error) {
+	return o.f.WriteAt(p, off)
+}
+
+func (o *localObject) Finalize() error {
+	if o.sync {
+		err := SyncFile(o.f)
+		if err != nil {
+			o.f.Close()
+			return err
+		}
+	}
+	err := o.f.Close()
+	if err != nil {
+		return fmt.Errorf("in storage.Finalize unable to close file %q: %v", o.f.Name(), err)
+	}
+	if o.sync {
+		return SyncDir(filepath.Dir(o.f.Name()))
+	}
+	return nil
+}
+
+func (o *localObject) Abort() error {
+	o.f.Close()
+
+	err := os.Remove(o.f.Name())
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("in storage.Abort unable to remove file %q: %v", o.f.Name(), err)
+	}
+	return nil
+}
+
+func (l *LocalStruct) Delete(key string) error {
+	fileName, err := l.fileName(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(fileName)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("in storage.Delete unable to remove file %q: %v", fileName, err)
+	}
+	return nil
+}
+
+// List walks folder of prefix. Folders starting with dot keep service data and are skipped
+func (l *LocalStruct) List(prefix string) ([]string, error) {
+	folder := l.Path
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		folderName, err := l.fileName(prefix[:i])
+		if err != nil {
+			return nil, err
+		}
+		folder = folderName
+	}
+	keys := make([]string, 0)
+
+	err := filepath.WalkDir(folder, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && name == folder {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() {
+			if name != folder && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(l.Path, name)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("in storage.List unable to walk folder %q: %v", folder, err)
+	}
+	return keys, nil
+}
+
+// Move renames folder to key folder, so that submission appears at once
+func (l *LocalStruct) Move(folder, key string) error {
+	target, err := l.fileName(key)
+	if err != nil {
+		return err
+	}
+	_, err = os.Lstat(target)
+	if err == nil {
+		return repo.Permanent(fmt.Errorf("in storage.Move %q already exists", key))
+	}
+	if !os.IsNotExist(err) {
+		return fmt.Errorf("in storage.Move unable to stat %q: %v", target, err)
+	}
+	err = os.Rename(folder, target)
+	if err != nil {
+		return fmt.Errorf("in storage.Move unable to move folder %q to %q: %v", folder, target, err)
+	}
+	if !l.Sync {
+		return nil
+	}
+	err = SyncDir(filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+	return SyncDir(filepath.Dir(folder))
+}
+
+// SyncFile flushes contents of f to disk
+func SyncFile(f *os.File) error {
+	defer metrics.Fsync(time.Now())
+
+	err := f.Sync()
+	if err != nil {
+		return fmt.Errorf("in storage.SyncFile unable to sync file %q: %v", f.Name(), err)
+	}
+	return nil
+}
+
+// SyncDir flushes directory entries of folderName to disk,
+// so that newly created files survive a crash
+func SyncDir(folderName string) error {
+	defer metrics.Fsync(time.Now())
+
+	d, err := os.Open(folderName)
+	if err != nil {
+		return fmt.Errorf("in storage.SyncDir unable to open folder %q: %v", folderName, err)
+	}
+	defer d.Close()
+
+	err = d.Sync()
+	if err != nil {
+		return fmt.Errorf("in storage.SyncDir unable to sync folder %q: %v", folderName, err)
+	}
+	return nil
+}
@@ -0,0 +1,310 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vynovikov/highLoadSaver/internal/config"
+	"github.com/vynovikov/highLoadSaver/internal/repo"
+)
+
+// S3Struct keeps objects in bucket of S3-compatible storage, e.g. AWS S3 or MinIO.
+// Bucket is addressed in path style, object keys are prefixed by Prefix
+type S3Struct struct {
+	Endpoint  *url.URL
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	PartSize  int64 // how much of object is buffered before it is sent, S3 requires at least 5 MiB
+	Client    *http.Client
+}
+
+func NewS3(c *config.Config) (*S3Struct, error) {
+	endpoint, err := url.Parse(c.S3Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("in storage.NewS3 unable to parse endpoint %q: %v", c.S3Endpoint, err)
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("in storage.NewS3 endpoint %q must be http or https URL", c.S3Endpoint)
+	}
+	if c.S3PartSize <= 0 {
+		return nil, fmt.Errorf("in storage.NewS3 part size must be positive, got %d", c.S3PartSize)
+	}
+	return &S3Struct{
+		Endpoint:  endpoint,
+		Region:    c.S3Region,
+		Bucket:    c.S3Bucket,
+		Prefix:    c.S3Prefix,
+		AccessKey: c.S3AccessKey,
+		SecretKey: c.S3SecretKey,
+		PartSize:  c.S3PartSize,
+		Client:    &http.Client{Timeout: 10 * time.Minute},
+	}, nil
+}
+
+// s3Object is written sequentially. Data is buffered in memory up to part size and sent as parts of multipart upload,
+// so object is never staged locally. Object not exceeding part size is sent by single PUT when it is finalized
+type s3Object struct {
+	d        *S3Struct
+	key      string
+	buf      []byte
+	off      int64  // offset next write must start at
+	uploadID string // empty until first part is sent
+	parts    []completedPart
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (d *S3Struct) Create(key string) (Object, error) {
+	return &s3Object{d: d, key: key}, nil
+}
+
+func (o *s3Object) WriteAt(p []byte, off int64) (int, error) {
+	if off != o.off {
+		return 0, fmt.Errorf("in storage.WriteAt object %q is written sequentially, expected offset %d, got %d", o.key, o.off, off)
+	}
+	data := append(o.buf, p...)
+	sent := 0
+	for int64(len(data)-sent) >= o.d.PartSize {
+		err := o.uploadPart(data[sent : sent+int(o.d.PartSize)])
+		if err != nil && sent == 0 {
+			// nothing is accepted, so that p can be written again
+			return 0, err
+		}
+		if err != nil {
+			// p is accepted partly, the rest stays buffered and is sent by next write or Finalize
+			break
+		}
+		sent += int(o.d.PartSize)
+	}
+	o.buf = append(o.buf[:0], data[sent:]...)
+	o.off += int64(len(p))
+
+	return len(p), nil
+}
+
+func (o *s3Object) Finalize() error {
+	if len(o.uploadID) == 0 {
+		resp, err := o.d.do(http.MethodPut, o.key, nil, bytes.NewReader(o.buf), int64(len(o.buf)), unsignedPayload)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		o.buf = nil
+
+		return nil
+	}
+	if len(o.buf) > 0 {
+		err := o.uploadPart(o.buf)
+		if err != nil {
+			return err
+		}
+		o.buf = nil
+	}
+	return o.complete()
+}
+
+func (o *s3Object) Abort() error {
+	o.buf = nil
+	if len(o.uploadID) == 0 {
+		return nil
+	}
+	resp, err := o.d.do(http.MethodDelete, o.key, url.Values{"uploadId": {o.uploadID}}, http.NoBody, 0, emptyPayload)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	o.uploadID = ""
+
+	return nil
+}
+
+// uploadPart sends data as next part, initiating multipart upload first if needed
+func (o *s3Object) uploadPart(data []byte) error {
+	if len(o.uploadID) == 0 {
+		resp, err := o.d.do(http.MethodPost, o.key, url.Values{"uploads": {""}}, http.NoBody, 0, emptyPayload)
+		if err != nil {
+			return err
+		}
+		result := struct {
+			UploadID string `xml:"UploadId"`
+		}{}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil || len(result.UploadID) == 0 {
+			return fmt.Errorf("in storage.uploadPart unable to initiate upload of %q: %v", o.key, err)
+		}
+		o.uploadID = result.UploadID
+	}
+	n := len(o.parts) + 1
+	query := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {o.uploadID}}
+
+	resp, err := o.d.do(http.MethodPut, o.key, query, bytes.NewReader(data), int64(len(data)), unsignedPayload)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	o.parts = append(o.parts, completedPart{PartNumber: n, ETag: resp.Header.Get("ETag")})
+
+	return nil
+}
+
+// complete assembles object from sent parts
+func (o *s3Object) complete() error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: o.parts})
+	if err != nil {
+		return fmt.Errorf("in storage.complete unable to marshal parts of %q: %v", o.key, err)
+	}
+	resp, err := o.d.do(http.MethodPost, o.key, url.Values{"uploadId": {o.uploadID}}, bytes.NewReader(body), int64(len(body)), hexSHA256(string(body)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// failure may be reported with 200 OK once response has started
+	result := struct {
+		XMLName xml.Name
+		Message string `xml:"Message"`
+	}{}
+	err = xml.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return fmt.Errorf("in storage.complete unable to decode response for %q: %v", o.key, err)
+	}
+	if result.XMLName.Local == "Error" {
+		return fmt.Errorf("in storage.complete unable to complete upload of %q: %s", o.key, result.Message)
+	}
+	o.uploadID = ""
+
+	return nil
+}
+
+// AbortAll aborts multipart uploads of objects under prefix
+func (d *S3Struct) AbortAll(prefix string) error {
+	query := url.Values{"uploads": {""}, "prefix": {d.Prefix + prefix}}
+
+	for {
+		resp, err := d.do(http.MethodGet, "", query, http.NoBody, 0, emptyPayload)
+		if err != nil {
+			return err
+		}
+		result := struct {
+			Uploads []struct {
+				Key      string `xml:"Key"`
+				UploadID string `xml:"UploadId"`
+			} `xml:"Upload"`
+			IsTruncated        bool   `xml:"IsTruncated"`
+			NextKeyMarker      string `xml:"NextKeyMarker"`
+			NextUploadIDMarker string `xml:"NextUploadIdMarker"`
+		}{}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("in storage.AbortAll unable to decode listing of %q: %v", prefix, err)
+		}
+		for _, u := range result.Uploads {
+			o := &s3Object{d: d, key: strings.TrimPrefix(u.Key, d.Prefix), uploadID: u.UploadID}
+			err = o.Abort()
+			if err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated {
+			return nil
+		}
+		query.Set("key-marker", result.NextKeyMarker)
+		query.Set("upload-id-marker", result.NextUploadIDMarker)
+	}
+}
+
+func (d *S3Struct) Delete(key string) error {
+	resp, err := d.do(http.MethodDelete, key, nil, http.NoBody, 0, emptyPayload)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// listResult is response of ListObjectsV2
+type listResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (d *S3Struct) List(prefix string) ([]string, error) {
+	keys := make([]string, 0)
+	query := url.Values{"list-type": {"2"}, "prefix": {d.Prefix + prefix}}
+
+	for {
+		resp, err := d.do(http.MethodGet, "", query, http.NoBody, 0, emptyPayload)
+		if err != nil {
+			return nil, err
+		}
+		result := listResult{}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("in storage.List unable to decode listing of %q: %v", prefix, err)
+		}
+		for _, c := range result.Contents {
+			keys = append(keys, strings.TrimPrefix(c.Key, d.Prefix))
+		}
+		if !result.IsTruncated || len(result.NextContinuationToken) == 0 {
+			return keys, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// do sends signed request for object key, or for bucket itself if key is empty.
+// Responses other than 2xx are turned into errors. Client errors are permanent, but for timeout and throttling
+func (d *S3Struct) do(method, key string, query url.Values, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	u := *d.Endpoint
+	u.Path = "/" + d.Bucket
+	if len(key) > 0 {
+		u.Path += "/" + d.Prefix + key
+	}
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("in storage.do unable to create request: %v", err)
+	}
+	req.ContentLength = size
+	d.sign(req, payloadHash, time.Now())
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("in storage.do %s %q failed: %v", method, key, err)
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		err = fmt.Errorf("in storage.do %s %q failed with %s: %s", method, key, resp.Status, msg)
+		if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+			return nil, repo.Permanent(err)
+		}
+		return nil, err
+	}
+	return resp, nil
+}
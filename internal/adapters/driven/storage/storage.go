@@ -0,0 +1,49 @@
+// Storage adapter.
+// Keeps published submissions as objects on local disk or in S3-compatible object storage
+package storage
+
+import (
+	"io"
+
+	"github.com/vynovikov/highLoadSaver/internal/config"
+)
+
+// Driver stores objects addressed by slash separated keys, e.g. <ts>/<file>
+type Driver interface {
+	// Create starts writing object key, replacing existing one
+	Create(key string) (Object, error)
+	// Delete deletes object key, missing object is not an error
+	Delete(key string) error
+	// List returns keys of objects starting with prefix
+	List(prefix string) ([]string, error)
+}
+
+// Object is being written until it is either finalized or aborted
+type Object interface {
+	io.WriterAt
+	// Finalize makes written data durable and visible under object key
+	Finalize() error
+	// Abort discards written data
+	Abort() error
+}
+
+// Mover is implemented by drivers which can take local folder over as a whole without copying it
+type Mover interface {
+	// Move makes contents of folder objects under key/ prefix, key must not exist yet
+	Move(folder, key string) error
+}
+
+// Streamer is implemented by drivers whose objects are written sequentially straight to storage,
+// so that chunks need not be staged locally. Data of unfinished objects does not survive restart
+type Streamer interface {
+	// AbortAll discards unfinished objects under prefix, e.g. left by previous run
+	AbortAll(prefix string) error
+}
+
+// New returns driver chosen by c
+func New(c *config.Config) (Driver, error) {
+	if c.Storage == config.StorageS3 {
+		return NewS3(c)
+	}
+	return NewLocal(c.ResultsPath, c.Fsync != config.FsyncNone), nil
+}
@@ -3,138 +3,373 @@ package rpc
 
 import (
 	"context"
-	"net"
-	"os"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/segmentio/kafka-go"
 	"github.com/vynovikov/highLoadSaver/internal/adapters/application"
-	"github.com/vynovikov/highLoadSaver/internal/adapters/driver/rpc/pb"
+	"github.com/vynovikov/highLoadSaver/internal/config"
 	"github.com/vynovikov/highLoadSaver/internal/logger"
-	"google.golang.org/protobuf/proto"
+	"github.com/vynovikov/highLoadSaver/internal/metrics"
+	"github.com/vynovikov/highLoadSaver/internal/repo"
 )
 
 type ReceiverStruct struct {
-	A application.Application
-	R *kafka.Reader
-	l sync.Mutex
+	A                application.Application
+	R                Reader                                // nil until Run connects
+	D                Writer                                // publishes messages given up to dead-letter topic, nil if there is none
+	connect          func(context.Context) (Reader, error) // builds reader, failing while broker or topic is unavailable
+	commit           bool                                  // offsets are committed, reader of explicit partition has no group to commit to
+	committed        map[int]int64                         // offsets committed by current reader keyed by partition
+	connectTimeout   time.Duration                         // how long connecting may fail before it is given up, zero means forever
+	reconnectBackoff time.Duration                         // delay before second attempt to connect, doubled for each next one
+	reconnectMax     time.Duration
+	attempts         int           // how many times message failing transiently is handled before it is given up
+	backoff          time.Duration // delay before second attempt, doubled for each next one
+	backoffMax       time.Duration
+	l                sync.Mutex
 }
 type Receiver interface {
 	Run()
 }
 
-func NewReceiver(a application.Application) *ReceiverStruct {
+// Reader is implemented by kafka.Reader
+type Reader interface {
+	FetchMessage(context.Context) (kafka.Message, error)
+	CommitMessages(context.Context, ...kafka.Message) error
+	Close() error
+}
 
-	var (
-		conn       *kafka.Conn
-		err        error
-		partitions []kafka.Partition
-	)
+// Writer is implemented by kafka.Writer
+type Writer interface {
+	WriteMessages(context.Context, ...kafka.Message) error
+	Close() error
+}
 
-	kafkaAddr := os.Getenv("KAFKA_ADDR")
-	kafkaPort := os.Getenv("KAFKA_PORT")
+// headers added to dead-lettered messages, original headers are kept
+const (
+	HeaderReason    = "dlq-reason" // malformed, rejected or unsaveable
+	HeaderError     = "dlq-error"
+	HeaderTopic     = "dlq-topic"
+	HeaderPartition = "dlq-partition"
+	HeaderOffset    = "dlq-offset"
+	HeaderAttempts  = "dlq-attempts"
+	HeaderTime      = "dlq-time" // RFC 3339
+)
 
-	dialURI := net.JoinHostPort(kafkaAddr, kafkaPort)
+const (
+	ReasonMalformed  = "malformed"  // message cannot be decoded
+	ReasonRejected   = "rejected"   // saver failed permanently, e.g. submission is already completed
+	ReasonUnsaveable = "unsaveable" // saver failed transiently in all attempts
+)
 
-	kafkaTopic := os.Getenv("KAFKA_TOPIC")
+// NewReceiver returns receiver of kafka topic configured by c.
+// It does not connect, Run does and keeps reconnecting as long as it runs
+func NewReceiver(a application.Application, c *config.Config) *ReceiverStruct {
+
+	rc := readerConfig(c)
+
+	rs := &ReceiverStruct{
+		A: a,
+		connect: func(ctx context.Context) (Reader, error) {
+			return connect(ctx, rc, startOffset(rc, a), dial)
+		},
+		commit:           len(rc.GroupID) > 0,
+		connectTimeout:   c.ConnectTimeout,
+		reconnectBackoff: c.ReconnectBackoff,
+		reconnectMax:     c.ReconnectMax,
+		attempts:         c.SaveAttempts,
+		backoff:          c.RetryBackoff,
+		backoffMax:       c.RetryBackoffMax,
+	}
+	if len(c.DeadLetterTopic) > 0 {
+		rs.D = &kafka.Writer{
+			Addr:         kafka.TCP(c.KafkaBrokers...),
+			Topic:        c.DeadLetterTopic,
+			RequiredAcks: kafka.RequireAll,
+		}
+	}
+	return rs
+}
 
-	dialURI = net.JoinHostPort(kafkaAddr, kafkaPort)
+// readerConfig returns reader settings of c. Reader of explicit partition has no consumer group
+func readerConfig(c *config.Config) kafka.ReaderConfig {
+	rc := kafka.ReaderConfig{
+		Brokers:           c.KafkaBrokers,
+		Topic:             c.KafkaTopic,
+		GroupID:           c.KafkaGroupID,
+		MinBytes:          c.KafkaMinBytes,
+		MaxBytes:          c.KafkaMaxBytes,
+		MaxWait:           c.KafkaMaxWait,
+		StartOffset:       kafka.FirstOffset,
+		SessionTimeout:    c.KafkaSessionTimeout,
+		HeartbeatInterval: c.KafkaHeartbeatInterval,
+		IsolationLevel:    kafka.ReadUncommitted,
+		// commits are synchronous, Run commits each message after it has been saved
+		CommitInterval: 0,
+	}
+	if c.KafkaPartition >= 0 {
+		rc.GroupID, rc.Partition = "", c.KafkaPartition
+	}
+	if c.KafkaStartOffset == config.OffsetLast {
+		rc.StartOffset = kafka.LastOffset
+	}
+	if c.KafkaIsolationLevel == config.IsolationCommitted {
+		rc.IsolationLevel = kafka.ReadCommitted
+	}
+	return rc
+}
+
+// startOffset returns offset reader of explicit partition starts from: the one application resumes from,
+// or start offset of rc if none of its messages has been saved yet
+func startOffset(rc kafka.ReaderConfig, a application.Application) int64 {
+	if o := a.Resume(rc.Partition); o >= 0 {
+		return o
+	}
+	return rc.StartOffset
+}
 
-	for i := 0; i < 5; i++ {
+// Run connects to kafka, fetches messages and passes them to application.
+// Offset is committed only after message has been saved, so delivery is at-least-once.
+// Application may hold offsets back further, e.g. until data kept in memory is stored.
+// Reader of explicit partition commits nothing, after restart it reads partition from where saver left off, past dead-lettered messages,
+// or from start offset if saver has saved nothing of it yet.
+// Message failing transiently is tried again after backoff, fetching waits meanwhile, so partition is not read past it.
+// Message which is malformed, fails permanently or is not saved in all attempts is published to dead-letter topic and committed then,
+// publishing is tried again until it succeeds. Submission of such message is given up.
+// Without dead-letter topic such message fails application, nothing is committed past it.
+// Reader failing to fetch is rebuilt. Kafka staying unreachable for longer than connect timeout
+// or refusing access for good fails application.
+// Run returns when application context is cancelled, after in-flight message is committed or left to be redelivered
+func (r *ReceiverStruct) Run() {
 
-		conn, err = kafka.Dial("tcp", dialURI)
-		if err != nil {
+	defer r.A.Drained()
 
-			logger.L.Errorf("in rpc.NewReceiver cannot dial: %v. Trying again\n", err)
+	ctx := r.A.Context()
 
-			time.Sleep(time.Second * 10)
+	failures := 0
 
-			continue
+	for {
+		if r.R == nil {
+			err := r.supervise(ctx)
+			if err != nil {
+				r.close()
+
+				if ctx.Err() == nil {
+					r.A.Fail(err)
+				}
+				return
+			}
 		}
 
-		partitions, err = conn.ReadPartitions()
+		logger.L.Infoln("waiting for kafka messages...")
 
-		if err != nil {
+		fetched, err := r.consume(ctx)
 
-			time.Sleep(time.Second * 10)
+		if ctx.Err() != nil {
 
-			continue
+			logger.L.Infoln("in rpc.Run application is stopping, fetching is over")
 
+			r.close()
+
+			return
 		}
+		if errors.Is(err, errUnhandled) {
+			r.close()
 
-		for _, p := range partitions {
+			r.A.Fail(err)
 
-			if p.Topic == kafkaTopic {
+			return
+		}
+		if fatal(err) {
+			r.close()
 
-				conn.Close()
+			r.A.Fail(fmt.Errorf("in rpc.Run cannot fetch from kafka anymore: %v", err))
 
-				rs := &ReceiverStruct{
+			return
+		}
+		if fetched > 0 {
+			failures = 0
+		}
+		failures++
+		d := backoff(failures, r.reconnectBackoff, r.reconnectMax)
 
-					A: a,
-					R: kafka.NewReader(kafka.ReaderConfig{
-						Brokers: []string{dialURI},
-						Topic:   kafkaTopic,
-						GroupID: "0",
-					}),
-				}
+		logger.L.Errorf("in rpc.Run cannot fetch from kafka, reader is rebuilt in %v: %v\n", d, err)
 
-				logger.L.Infof("in rpc.NewReceiver rs: %v\n", rs.R)
+		r.drop()
+		metrics.Reconnects.Add(1)
 
-				return rs
-			}
-		}
+		// cancelled wait ends with next fetch
+		wait(ctx, d)
 	}
-
-	return &ReceiverStruct{}
 }
 
-func (r *ReceiverStruct) Run() {
-
-	logger.L.Infoln("waiting for kafka messages...")
+// errUnhandled stops receiver on message which is neither handled nor dead-lettered, so that no commit covers it
+var errUnhandled = errors.New("is neither saved nor dead-lettered")
 
-	for {
-		m, err := r.R.ReadMessage(context.Background())
+// consume fetches and handles messages until fetching fails or message cannot be passed. It returns number of messages fetched
+func (r *ReceiverStruct) consume(ctx context.Context) (int, error) {
+	r.committed = make(map[int]int64)
 
+	for n := 0; ; n++ {
+		m, err := r.R.FetchMessage(ctx)
 		if err != nil {
-
-			logger.L.Errorf("in rpc.Run cannot read from kafka: %v receiver: %v\n", err, r.R)
+			return n, err
 		}
 
-		logger.L.Infof("in rpc.Run from message have read topic: %s, partition = %d, key: %q, value: %q\n", m.Topic, m.Partition, m.Key, m.Value)
+		logger.L.Infof("in rpc.consume from message have read topic: %s, partition = %d, offset = %d\n", m.Topic, m.Partition, m.Offset)
 
-		header, body := &pb.MessageHeader{}, &pb.MessageBody{}
+		if attempts, err := r.handle(ctx, m); err != nil {
+			logger.L.Errorf("in rpc.consume cannot handle message: %v\n", err)
 
-		if err = proto.Unmarshal(m.Key, header); err != nil {
-			logger.L.Errorf("in rpc.Run failed to unmarshal: %v\n", err)
-		}
-		logger.L.Infof("in rpc.Run unmarshalled header: %v\n", header)
+			if ctx.Err() != nil && !permanent(err) {
+				logger.L.Warnf("in rpc.consume application is stopping, message at partition %d offset %d is left to be redelivered\n", m.Partition, m.Offset)
+
+				// nothing is committed past it
+				return n + 1, ctx.Err()
+			}
+			if r.D == nil {
+				return n + 1, fmt.Errorf("in rpc.consume message at partition %d offset %d %w: %v", m.Partition, m.Offset, errUnhandled, err)
+			}
+			if err = r.deadLetter(ctx, m, err, attempts); err != nil {
+				logger.L.Warnf("in rpc.consume application is stopping, message at partition %d offset %d is left to be redelivered: %v\n", m.Partition, m.Offset, err)
 
-		if err = proto.Unmarshal(m.Value, body); err != nil {
-			logger.L.Errorf("in rpc.Run failed to unmarshal: %v\n", err)
+				return n + 1, err
+			}
+			r.A.GiveUp(m)
 		}
-		logger.L.Infof("in rpc.Run unmarshalled body: %v\n", body)
 
+		if !r.commit {
+			continue
+		}
+		c := r.A.Committable(m)
+		if last, ok := r.committed[m.Partition]; c < 0 || ok && c <= last {
+			continue
+		}
+		// in-flight message is committed even if application is stopping meanwhile
+		if err = r.R.CommitMessages(context.Background(), kafka.Message{Topic: m.Topic, Partition: m.Partition, Offset: c}); err != nil {
+			logger.L.Errorf("in rpc.consume cannot commit offset %d of partition %d: %v\n", c, m.Partition, err)
+			continue
+		}
+		r.committed[m.Partition] = c
 	}
-	/*
-			if err = r.A.HandleKafkaMessage(m); err != nil {
-				logger.L.Errorf("in rpc.Run cannot handle message: %v\n", err)
-			}
+}
+
+// handle passes m to application, trying it again after backoff while it fails transiently and attempts are left.
+// Waiting is cut short when ctx is cancelled. It returns number of attempts made
+func (r *ReceiverStruct) handle(ctx context.Context, m kafka.Message) (int, error) {
+	for i := 1; ; i++ {
+		err := r.A.HandleKafkaMessage(m)
+		if err == nil || permanent(err) || i >= r.attempts {
+			return i, err
 		}
-	*/
-	/*
-		batch := r.c.ReadBatch(10, 1e6)
-		logger.L.Infof("in rpc.Run waiting for new messages from kafka %s topic ...\n", os.Getenv("KAFKA_TOPIC"))
+		d := backoff(i, r.backoff, r.backoffMax)
+		logger.L.Warnf("in rpc.handle attempt %d of %d to handle message at partition %d offset %d failed, trying again in %v: %v\n", i, r.attempts, m.Partition, m.Offset, d, err)
+		metrics.Retries.Add(1)
 
-		for {
-			m, err := batch.ReadMessage()
-			if err != nil {
+		if !wait(ctx, d) {
+			return i, err
+		}
+	}
+}
 
-			}
-			err = r.A.HandleKafkaMessage(m)
-			if err != nil {
-				logger.L.Errorf("in rpc.Run cannot handle message: %v\n", err)
-			}
+// wait sleeps for d, it returns false if ctx is cancelled meanwhile
+func wait(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// fatal tells whether kafka refuses to serve receiver for good, e.g. because it is not authorized.
+// Other errors, e.g. unavailable broker or closed connection, may go away when reader is rebuilt
+func fatal(err error) bool {
+	var ke kafka.Error
+	return errors.As(err, &ke) && !ke.Temporary()
+}
+
+// backoff returns delay before attempt n+1. It is base doubled for each attempt after first one, capped by max,
+// half of it being random, so that receivers failing together do not retry together
+func backoff(n int, base, max time.Duration) time.Duration {
+	d := base
+	for i := 1; i < n && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d-d/2)+1))
+}
+
+// permanent tells whether handling fails again however many times it is tried
+func permanent(err error) bool {
+	var me *application.MalformedError
+	return errors.As(err, &me) || repo.IsPermanent(err)
+}
+
+// deadLetter publishes m which is given up because of cause to dead-letter topic.
+// Key and value are kept as they are, error metadata goes to headers.
+// Publishing is tried again after backoff until it succeeds, so that m is not committed before it is kept somewhere.
+// It fails only if ctx is cancelled meanwhile
+func (r *ReceiverStruct) deadLetter(ctx context.Context, m kafka.Message, cause error, attempts int) error {
+	reason := ReasonUnsaveable
+	var me *application.MalformedError
+	switch {
+	case errors.As(cause, &me):
+		reason = ReasonMalformed
+	case repo.IsPermanent(cause):
+		reason = ReasonRejected
+	}
+	headers := make([]kafka.Header, 0, len(m.Headers)+7)
+	headers = append(headers, m.Headers...)
+	headers = append(headers,
+		kafka.Header{Key: HeaderReason, Value: []byte(reason)},
+		kafka.Header{Key: HeaderError, Value: []byte(cause.Error())},
+		kafka.Header{Key: HeaderTopic, Value: []byte(m.Topic)},
+		kafka.Header{Key: HeaderPartition, Value: []byte(strconv.Itoa(m.Partition))},
+		kafka.Header{Key: HeaderOffset, Value: []byte(strconv.FormatInt(m.Offset, 10))},
+		kafka.Header{Key: HeaderAttempts, Value: []byte(strconv.Itoa(attempts))},
+		kafka.Header{Key: HeaderTime, Value: []byte(time.Now().UTC().Format(time.RFC3339))},
+	)
+	for i := 1; ; i++ {
+		// in-flight message is dead-lettered even if application is stopping meanwhile
+		err := r.D.WriteMessages(context.Background(), kafka.Message{Key: m.Key, Value: m.Value, Headers: headers})
+		if err == nil {
+			break
+		}
+		d := backoff(i, r.backoff, r.backoffMax)
+		logger.L.Errorf("in rpc.deadLetter attempt %d to publish message at partition %d offset %d failed, trying again in %v: %v\n", i, m.Partition, m.Offset, d, err)
+
+		if !wait(ctx, d) {
+			return fmt.Errorf("in rpc.deadLetter cannot publish message at partition %d offset %d: %v", m.Partition, m.Offset, err)
 		}
-	*/
+	}
+	logger.L.Warnf("in rpc.deadLetter message at partition %d offset %d is published to dead-letter topic, reason %q\n", m.Partition, m.Offset, reason)
+	metrics.DeadLetters.Add(1)
+
+	return nil
+}
+
+// close closes reader and dead-letter writer
+func (r *ReceiverStruct) close() {
+	r.drop()
+
+	if r.D == nil {
+		return
+	}
+	if err := r.D.Close(); err != nil {
+		logger.L.Errorf("in rpc.close cannot close dead-letter writer: %v\n", err)
+	}
 }
@@ -0,0 +1,706 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/suite"
+	"github.com/vynovikov/highLoadSaver/internal/adapters/application"
+	"github.com/vynovikov/highLoadSaver/internal/adapters/driven/saver"
+	"github.com/vynovikov/highLoadSaver/internal/config"
+	"github.com/vynovikov/highLoadSaver/internal/metrics"
+	"github.com/vynovikov/highLoadSaver/internal/repo"
+)
+
+type receiverSuite struct {
+	suite.Suite
+}
+
+func TestReceiverSuite(t *testing.T) {
+	suite.Run(t, new(receiverSuite))
+}
+
+// readerMock returns its errors, then its messages in order until application context is cancelled, then it cancels it.
+// If end is set, it fails with end instead of cancelling
+type readerMock struct {
+	errs      []error
+	messages  []kafka.Message
+	end       error
+	committed []int64
+	cancel    context.CancelFunc
+	closed    bool
+}
+
+func (r *readerMock) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	if len(r.errs) > 0 {
+		err := r.errs[0]
+		r.errs = r.errs[1:]
+		return kafka.Message{}, err
+	}
+	if len(r.messages) == 0 && r.end != nil {
+		return kafka.Message{}, r.end
+	}
+	if len(r.messages) == 0 || ctx.Err() != nil {
+		r.cancel()
+		return kafka.Message{}, ctx.Err()
+	}
+	m := r.messages[0]
+	r.messages = r.messages[1:]
+	return m, nil
+}
+
+func (r *readerMock) CommitMessages(ctx context.Context, ms ...kafka.Message) error {
+	for _, m := range ms {
+		r.committed = append(r.committed, m.Offset)
+	}
+	return nil
+}
+
+func (r *readerMock) Close() error {
+	r.closed = true
+	return nil
+}
+
+// writerMock fails with its errors first, then it takes messages
+type writerMock struct {
+	messages []kafka.Message
+	errs     []error
+	closed   bool
+}
+
+func (w *writerMock) WriteMessages(ctx context.Context, ms ...kafka.Message) error {
+	if len(w.errs) > 0 {
+		err := w.errs[0]
+		w.errs = w.errs[1:]
+		return err
+	}
+	w.messages = append(w.messages, ms...)
+	return nil
+}
+
+func (w *writerMock) Close() error {
+	w.closed = true
+	return nil
+}
+
+// appMock fails handling of message as many times as errs has errors for its offset.
+// Application is stopped by first failure if stop is set
+type appMock struct {
+	ctx     context.Context
+	errs    map[int64][]error
+	handled map[int64]int
+	held    map[int64]int64 // offset committable after message at offset, message offset itself if absent
+	givenUp []int64
+	resume  map[int]int64 // offsets partitions are resumed from
+	stop    context.CancelFunc
+	drained bool
+	failed  error
+	l       sync.Mutex
+}
+
+func (a *appMock) HandleKafkaMessage(m kafka.Message) error {
+	a.l.Lock()
+	defer a.l.Unlock()
+
+	a.handled[m.Offset]++
+	if errs := a.errs[m.Offset]; len(errs) > 0 {
+		a.errs[m.Offset] = errs[1:]
+		if a.stop != nil {
+			a.stop()
+		}
+		return errs[0]
+	}
+	return nil
+}
+
+func (a *appMock) Committable(m kafka.Message) int64 {
+	if c, ok := a.held[m.Offset]; ok {
+		return c
+	}
+	return m.Offset
+}
+
+func (a *appMock) GiveUp(m kafka.Message) { a.givenUp = append(a.givenUp, m.Offset) }
+
+func (a *appMock) Resume(partition int) int64 {
+	if o, ok := a.resume[partition]; ok {
+		return o
+	}
+	return -1
+}
+
+func (a *appMock) Context() context.Context { return a.ctx }
+func (a *appMock) Drained()                 { a.drained = true }
+func (a *appMock) Fail(err error)           { a.failed = err }
+func (a *appMock) Reload(*config.Config)    {}
+func (a *appMock) Stop()                    {}
+
+func headers(m kafka.Message) map[string]string {
+	res := make(map[string]string)
+	for _, h := range m.Headers {
+		res[h.Key] = string(h.Value)
+	}
+	return res
+}
+
+func (s *receiverSuite) TestRun() {
+	malformed := &application.MalformedError{Err: errors.New("no ts")}
+	full := errors.New("disk is full")
+	mismatch := repo.Permanent(errors.New("chunk does not match its digest"))
+	down := errors.New("broker is down")
+
+	tt := []struct {
+		name          string
+		errs          map[int64][]error
+		held          map[int64]int64
+		noDeadLetter  bool
+		writerErrs    []error
+		stopping      bool
+		noCommit      bool
+		wantHandled   map[int64]int
+		wantCommitted []int64
+		wantReasons   []string
+		wantAttempts  int
+		wantFailed    bool
+	}{
+		{
+			name:          "saved",
+			errs:          map[int64][]error{},
+			wantHandled:   map[int64]int{1: 1, 2: 1},
+			wantCommitted: []int64{1, 2},
+			wantReasons:   []string{},
+		},
+		{
+			name:          "held back",
+			errs:          map[int64][]error{},
+			held:          map[int64]int64{1: -1, 2: 1},
+			wantHandled:   map[int64]int{1: 1, 2: 1},
+			wantCommitted: []int64{1},
+			wantReasons:   []string{},
+		},
+		{
+			name:          "malformed",
+			errs:          map[int64][]error{1: {malformed}},
+			wantHandled:   map[int64]int{1: 1, 2: 1},
+			wantCommitted: []int64{1, 2},
+			wantReasons:   []string{ReasonMalformed},
+			wantAttempts:  1,
+		},
+		{
+			name:          "rejected",
+			errs:          map[int64][]error{1: {mismatch}},
+			wantHandled:   map[int64]int{1: 1, 2: 1},
+			wantCommitted: []int64{1, 2},
+			wantReasons:   []string{ReasonRejected},
+			wantAttempts:  1,
+		},
+		{
+			name:          "saved on retry",
+			errs:          map[int64][]error{1: {full, full}},
+			wantHandled:   map[int64]int{1: 3, 2: 1},
+			wantCommitted: []int64{1, 2},
+			wantReasons:   []string{},
+		},
+		{
+			name:          "unsaveable",
+			errs:          map[int64][]error{1: {full, full, full}},
+			wantHandled:   map[int64]int{1: 3, 2: 1},
+			wantCommitted: []int64{1, 2},
+			wantReasons:   []string{ReasonUnsaveable},
+			wantAttempts:  3,
+		},
+		{
+			name:          "rejected on retry",
+			errs:          map[int64][]error{1: {full, mismatch}},
+			wantHandled:   map[int64]int{1: 2, 2: 1},
+			wantCommitted: []int64{1, 2},
+			wantReasons:   []string{ReasonRejected},
+			wantAttempts:  2,
+		},
+		{
+			name:          "explicit partition",
+			errs:          map[int64][]error{1: {malformed}},
+			noCommit:      true,
+			wantHandled:   map[int64]int{1: 1, 2: 1},
+			wantCommitted: []int64{},
+			wantReasons:   []string{ReasonMalformed},
+			wantAttempts:  1,
+		},
+		{
+			name:          "stopping while retrying",
+			errs:          map[int64][]error{1: {full}},
+			stopping:      true,
+			wantHandled:   map[int64]int{1: 1},
+			wantCommitted: []int64{},
+			wantReasons:   []string{},
+		},
+		{
+			name:          "dead letter failed",
+			errs:          map[int64][]error{1: {malformed}},
+			writerErrs:    []error{down, down},
+			wantHandled:   map[int64]int{1: 1, 2: 1},
+			wantCommitted: []int64{1, 2},
+			wantReasons:   []string{ReasonMalformed},
+			wantAttempts:  1,
+		},
+		{
+			name:          "stopping while dead letter fails",
+			errs:          map[int64][]error{1: {malformed}},
+			writerErrs:    []error{down},
+			stopping:      true,
+			wantHandled:   map[int64]int{1: 1},
+			wantCommitted: []int64{},
+			wantReasons:   []string{},
+		},
+		{
+			name:          "no dead-letter topic",
+			errs:          map[int64][]error{1: {malformed}},
+			noDeadLetter:  true,
+			wantHandled:   map[int64]int{1: 1},
+			wantCommitted: []int64{},
+			wantReasons:   []string{},
+			wantFailed:    true,
+		},
+		{
+			name:          "unsaveable without dead-letter topic",
+			errs:          map[int64][]error{1: {full, full, full}},
+			noDeadLetter:  true,
+			wantHandled:   map[int64]int{1: 3},
+			wantCommitted: []int64{},
+			wantReasons:   []string{},
+			wantFailed:    true,
+		},
+	}
+	for _, v := range tt {
+		s.Run(v.name, func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			messages := []kafka.Message{
+				{Topic: "topic1", Partition: 2, Offset: 1, Key: []byte("key"), Value: []byte("value"), Headers: []kafka.Header{{Key: "trace", Value: []byte("abc")}}},
+				{Topic: "topic1", Partition: 2, Offset: 2},
+			}
+			rm := &readerMock{messages: messages, committed: []int64{}, cancel: cancel}
+			wm := &writerMock{errs: v.writerErrs}
+			am := &appMock{ctx: ctx, errs: v.errs, handled: make(map[int64]int), held: v.held}
+			r := &ReceiverStruct{A: am, R: rm, D: wm, commit: !v.noCommit, attempts: 3, backoff: time.Millisecond, backoffMax: 2 * time.Millisecond}
+			if v.noDeadLetter {
+				r.D = nil
+			}
+			if v.stopping {
+				am.stop = cancel
+				r.backoff, r.backoffMax = time.Hour, time.Hour
+			}
+
+			r.Run()
+
+			s.Equal(v.wantHandled, am.handled)
+			s.Equal(v.wantCommitted, rm.committed)
+			s.True(am.drained)
+			s.Equal(v.wantFailed, am.failed != nil)
+			s.True(rm.closed)
+			s.Equal(!v.noDeadLetter, wm.closed)
+
+			reasons, givenUp := []string{}, []int64{}
+			for _, m := range wm.messages {
+				h := headers(m)
+				reasons = append(reasons, h[HeaderReason])
+
+				s.Equal([]byte("key"), m.Key)
+				s.Equal([]byte("value"), m.Value)
+				s.Equal("abc", h["trace"])
+				s.Equal("topic1", h[HeaderTopic])
+				s.Equal("2", h[HeaderPartition])
+				s.Equal("1", h[HeaderOffset])
+				s.Equal(strconv.Itoa(v.wantAttempts), h[HeaderAttempts])
+				s.NotEmpty(h[HeaderError])
+				s.NotEmpty(h[HeaderTime])
+				givenUp = append(givenUp, 1)
+			}
+			s.Equal(v.wantReasons, reasons)
+			s.ElementsMatch(givenUp, am.givenUp)
+		})
+	}
+}
+
+// explicitApp is application with context of test, so that receiver is stopped without stopping application
+type explicitApp struct {
+	*application.ApplicationStruct
+	ctx context.Context
+}
+
+func (a *explicitApp) Context() context.Context { return a.ctx }
+
+func (s *receiverSuite) TestRunExplicitPartitionDeadLettered() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := &config.Config{ResultsPath: filepath.Join(s.T().TempDir(), "results"), TextInlineLimit: 64 << 10, SessionTimeout: time.Hour}
+	rc := kafka.ReaderConfig{Partition: 2, StartOffset: kafka.FirstOffset}
+
+	sv, err := saver.NewSaver(c)
+	s.Require().NoError(err)
+	a := &explicitApp{ApplicationStruct: application.NewAppStoreOnly(sv, c), ctx: ctx}
+
+	// first reader breaks after malformed message is dead-lettered, rebuilt one reads on
+	readers := []*readerMock{
+		{messages: []kafka.Message{{Partition: 2, Offset: 5, Key: []byte{0xff, 0xff}}}, end: io.EOF, cancel: cancel},
+		{cancel: cancel},
+	}
+	starts := []int64{}
+	wm := &writerMock{}
+	r := &ReceiverStruct{
+		A: a,
+		D: wm,
+		connect: func(ctx context.Context) (Reader, error) {
+			starts = append(starts, startOffset(rc, a))
+			rm := readers[0]
+			readers = readers[1:]
+			return rm, nil
+		},
+		reconnectBackoff: time.Millisecond,
+		reconnectMax:     time.Millisecond,
+		attempts:         1,
+	}
+
+	r.Run()
+
+	s.Len(wm.messages, 1)
+	s.Equal([]int64{kafka.FirstOffset, 6}, starts)
+	s.NoError(a.Err())
+	s.Require().NoError(sv.Close())
+
+	// restarted
+	sv, err = saver.NewSaver(c)
+	s.Require().NoError(err)
+	s.Equal(int64(6), startOffset(rc, application.NewAppStoreOnly(sv, c)))
+	s.NoError(sv.Close())
+}
+
+// connectMock fails with its errors first, then returns its readers in order.
+// Once both are exhausted it keeps failing, stopping application if stop is set
+type connectMock struct {
+	errs    []error
+	readers []*readerMock
+	given   []*readerMock
+	stop    context.CancelFunc
+	calls   int
+}
+
+func (c *connectMock) connect(ctx context.Context) (Reader, error) {
+	c.calls++
+	if len(c.errs) > 0 {
+		err := c.errs[0]
+		c.errs = c.errs[1:]
+		return nil, err
+	}
+	if len(c.readers) > 0 {
+		rm := c.readers[0]
+		c.readers = c.readers[1:]
+		c.given = append(c.given, rm)
+		return rm, nil
+	}
+	if c.stop != nil {
+		c.stop()
+	}
+	return nil, errors.New("connection refused")
+}
+
+func (s *receiverSuite) TestSupervise() {
+	refused := errors.New("connection refused")
+
+	tt := []struct {
+		name           string
+		connectErrs    []error
+		fetchErrs      [][]error // of each reader
+		connectTimeout time.Duration
+		stopping       bool
+		wantHandled    map[int64]int
+		wantCalls      int
+		wantFailed     bool
+	}{
+		{
+			name:        "connected after outage",
+			connectErrs: []error{refused, fmt.Errorf("in rpc.connect topic %q is not created yet", "topic1"), kafka.LeaderNotAvailable},
+			fetchErrs:   [][]error{{}},
+			wantHandled: map[int64]int{1: 1},
+			wantCalls:   4,
+		},
+		{
+			name:        "rebuilt after outage",
+			fetchErrs:   [][]error{{io.EOF}, {refused}, {}},
+			wantHandled: map[int64]int{1: 1},
+			wantCalls:   3,
+		},
+		{
+			name:        "access refused while fetching",
+			fetchErrs:   [][]error{{kafka.TopicAuthorizationFailed}},
+			wantHandled: map[int64]int{},
+			wantCalls:   1,
+			wantFailed:  true,
+		},
+		{
+			name:        "access refused while connecting",
+			connectErrs: []error{refused, kafka.TopicAuthorizationFailed},
+			wantHandled: map[int64]int{},
+			wantCalls:   2,
+			wantFailed:  true,
+		},
+		{
+			name:           "connect timeout expired",
+			connectTimeout: 5 * time.Millisecond,
+			wantHandled:    map[int64]int{},
+			wantFailed:     true,
+		},
+		{
+			name:        "stopped while connecting",
+			connectErrs: []error{refused},
+			stopping:    true,
+			wantHandled: map[int64]int{},
+			wantCalls:   2,
+		},
+	}
+	for _, v := range tt {
+		s.Run(v.name, func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			cm := &connectMock{errs: v.connectErrs, readers: []*readerMock{}}
+			if v.stopping {
+				cm.stop = cancel
+			}
+			for _, errs := range v.fetchErrs {
+				cm.readers = append(cm.readers, &readerMock{errs: errs, messages: []kafka.Message{{Offset: 1}}, committed: []int64{}, cancel: cancel})
+			}
+			am := &appMock{ctx: ctx, errs: map[int64][]error{}, handled: make(map[int64]int)}
+			r := &ReceiverStruct{
+				A:                am,
+				connect:          cm.connect,
+				connectTimeout:   v.connectTimeout,
+				reconnectBackoff: time.Millisecond,
+				reconnectMax:     time.Millisecond,
+				attempts:         1,
+			}
+
+			r.Run()
+
+			s.Equal(v.wantHandled, am.handled)
+			s.True(am.drained)
+			s.Equal(v.wantFailed, am.failed != nil)
+			if v.wantCalls > 0 {
+				s.Equal(v.wantCalls, cm.calls)
+			}
+			s.Len(cm.given, len(v.fetchErrs))
+			for _, rm := range cm.given {
+				s.True(rm.closed)
+			}
+			s.Nil(r.R)
+			s.Equal(int64(0), metrics.Ready.Value())
+		})
+	}
+}
+
+// connMock reads its partitions or fails with its error
+type connMock struct {
+	partitions []kafka.Partition
+	err        error
+	closed     bool
+}
+
+func (c *connMock) ReadPartitions(topics ...string) ([]kafka.Partition, error) {
+	return c.partitions, c.err
+}
+
+func (c *connMock) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (s *receiverSuite) TestConnect() {
+	refused := errors.New("connection refused")
+
+	tt := []struct {
+		name       string
+		conn       *connMock
+		dialErr    error
+		partition  int
+		start      int64
+		wantErr    error
+		wantFatal  bool
+		wantReader bool
+	}{
+		{
+			name:       "connected",
+			conn:       &connMock{partitions: []kafka.Partition{{ID: 0}, {ID: 2}}},
+			partition:  2,
+			start:      8,
+			wantReader: true,
+		},
+		{
+			name:       "connected at last offset",
+			conn:       &connMock{partitions: []kafka.Partition{{ID: 0}, {ID: 2}}},
+			partition:  2,
+			start:      kafka.LastOffset,
+			wantReader: true,
+		},
+		{
+			name:    "broker unreachable",
+			dialErr: refused,
+			wantErr: refused,
+		},
+		{
+			name:      "access refused",
+			conn:      &connMock{err: kafka.TopicAuthorizationFailed},
+			wantErr:   kafka.TopicAuthorizationFailed,
+			wantFatal: true,
+		},
+		{
+			name:    "leader not available",
+			conn:    &connMock{err: kafka.LeaderNotAvailable},
+			wantErr: kafka.LeaderNotAvailable,
+		},
+		{
+			name: "topic not created",
+			conn: &connMock{partitions: []kafka.Partition{}},
+		},
+		{
+			name:      "partition not created",
+			conn:      &connMock{partitions: []kafka.Partition{{ID: 0}}},
+			partition: 2,
+		},
+	}
+	for _, v := range tt {
+		s.Run(v.name, func() {
+			dialed := []string{}
+			conn, dialErr := v.conn, v.dialErr
+			dial := func(ctx context.Context, address string) (Conn, error) {
+				dialed = append(dialed, address)
+				// first broker is always down
+				if len(dialed) == 1 {
+					return nil, refused
+				}
+				if dialErr != nil {
+					return nil, dialErr
+				}
+				return conn, nil
+			}
+			rc := kafka.ReaderConfig{Brokers: []string{"kafka1:9092", "kafka2:9092"}, Topic: "topic1", Partition: v.partition}
+
+			rd, err := connect(context.Background(), rc, v.start, dial)
+
+			s.Equal([]string{"kafka1:9092", "kafka2:9092"}, dialed)
+			if v.wantReader {
+				s.Require().NoError(err)
+				s.Equal(v.start, rd.(*kafka.Reader).Offset())
+				s.NoError(rd.Close())
+			} else {
+				s.Error(err)
+				s.Nil(rd)
+			}
+			if v.wantErr != nil {
+				s.ErrorIs(err, v.wantErr)
+			}
+			s.Equal(v.wantFatal, fatal(err))
+			if v.conn != nil {
+				s.True(v.conn.closed)
+			}
+		})
+	}
+}
+
+func (s *receiverSuite) TestReaderConfig() {
+	tt := []struct {
+		name          string
+		env           map[string]string
+		wantGroupID   string
+		wantPartition int
+		resume        map[int]int64
+		wantStart     int64
+		wantOffset    int64 // reader of explicit partition starts from
+		wantIsolation kafka.IsolationLevel
+		wantCommit    bool
+	}{
+		{
+			name:          "consumer group",
+			env:           map[string]string{"KAFKA_BROKERS": "kafka1:9092,kafka2:9092", "KAFKA_CONSUMER_GROUP_ID": "savers"},
+			wantGroupID:   "savers",
+			wantStart:     kafka.FirstOffset,
+			wantIsolation: kafka.ReadUncommitted,
+			wantCommit:    true,
+		},
+		{
+			name:          "explicit partition",
+			env:           map[string]string{"KAFKA_PARTITION": "2", "KAFKA_START_OFFSET": "last", "KAFKA_ISOLATION_LEVEL": "read_committed"},
+			wantPartition: 2,
+			wantStart:     kafka.LastOffset,
+			wantOffset:    kafka.LastOffset,
+			wantIsolation: kafka.ReadCommitted,
+		},
+		{
+			name:          "explicit partition resumed",
+			env:           map[string]string{"KAFKA_PARTITION": "2", "KAFKA_START_OFFSET": "last"},
+			resume:        map[int]int64{0: 3, 2: 8},
+			wantPartition: 2,
+			wantStart:     kafka.LastOffset,
+			wantOffset:    8,
+			wantIsolation: kafka.ReadUncommitted,
+		},
+	}
+	for _, v := range tt {
+		s.Run(v.name, func() {
+			s.T().Setenv("KAFKA_TOPIC", "topic1")
+			for _, k := range []string{"KAFKA_BROKERS", "KAFKA_CONSUMER_GROUP_ID", "KAFKA_PARTITION", "KAFKA_START_OFFSET", "KAFKA_ISOLATION_LEVEL"} {
+				s.T().Setenv(k, v.env[k])
+			}
+			c, err := config.Load()
+			s.Require().NoError(err)
+
+			rc := readerConfig(c)
+
+			s.NoError(rc.Validate())
+			s.Equal(c.KafkaBrokers, rc.Brokers)
+			s.Equal("topic1", rc.Topic)
+			s.Equal(v.wantGroupID, rc.GroupID)
+			s.Equal(v.wantPartition, rc.Partition)
+			s.Equal(v.wantStart, rc.StartOffset)
+			s.Equal(v.wantIsolation, rc.IsolationLevel)
+			s.Equal(v.wantCommit, NewReceiver(&appMock{}, c).commit)
+			if len(rc.GroupID) == 0 {
+				s.Equal(v.wantOffset, startOffset(rc, &appMock{resume: v.resume}))
+			}
+		})
+	}
+}
+
+func (s *receiverSuite) TestBackoff() {
+	tt := []struct {
+		name    string
+		n       int
+		base    time.Duration
+		max     time.Duration
+		wantMin time.Duration
+		wantMax time.Duration
+	}{
+		{name: "first", n: 1, base: time.Second, max: time.Minute, wantMin: 500 * time.Millisecond, wantMax: time.Second},
+		{name: "doubled", n: 3, base: time.Second, max: time.Minute, wantMin: 2 * time.Second, wantMax: 4 * time.Second},
+		{name: "capped", n: 100, base: time.Second, max: time.Minute, wantMin: 30 * time.Second, wantMax: time.Minute},
+		{name: "disabled", n: 2, base: 0, max: 0, wantMin: 0, wantMax: 0},
+	}
+	for _, v := range tt {
+		s.Run(v.name, func() {
+			for i := 0; i < 100; i++ {
+				d := backoff(v.n, v.base, v.max)
+				s.GreaterOrEqual(d, v.wantMin)
+				s.LessOrEqual(d, v.wantMax)
+			}
+		})
+	}
+}
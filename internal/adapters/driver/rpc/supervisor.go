@@ -0,0 +1,117 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/vynovikov/highLoadSaver/internal/logger"
+	"github.com/vynovikov/highLoadSaver/internal/metrics"
+)
+
+// supervise connects receiver, trying again with backoff while broker is unreachable or topic is not created yet.
+// It gives up when ctx is cancelled, when connect timeout expires or when kafka refuses access for good
+func (r *ReceiverStruct) supervise(ctx context.Context) error {
+	if r.connect == nil {
+		return fmt.Errorf("in rpc.supervise receiver has no way to connect to kafka")
+	}
+	start := time.Now()
+
+	for i := 1; ; i++ {
+		rd, err := r.connect(ctx)
+		if err == nil {
+			r.R = rd
+			metrics.Ready.Set(1)
+			logger.L.Infof("in rpc.supervise receiver is connected after %d attempts\n", i)
+
+			return nil
+		}
+		if fatal(err) {
+			return fmt.Errorf("in rpc.supervise kafka refuses connection: %v", err)
+		}
+		if r.connectTimeout > 0 && time.Since(start) >= r.connectTimeout {
+			return fmt.Errorf("in rpc.supervise cannot connect to kafka in %v: %v", r.connectTimeout, err)
+		}
+		d := backoff(i, r.reconnectBackoff, r.reconnectMax)
+
+		logger.L.Errorf("in rpc.supervise attempt %d to connect failed, trying again in %v: %v\n", i, d, err)
+
+		if !wait(ctx, d) {
+			return ctx.Err()
+		}
+	}
+}
+
+// Conn is implemented by kafka.Conn
+type Conn interface {
+	ReadPartitions(...string) ([]kafka.Partition, error)
+	Close() error
+}
+
+// dial connects to broker at address
+func dial(ctx context.Context, address string) (Conn, error) {
+	conn, err := kafka.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// connect dials first reachable broker and builds reader of rc once its topic exists.
+// Reader of explicit partition starts from offset start, reader of consumer group from committed one.
+// Errors are wrapped, so that kafka refusing access is told from outage by fatal
+func connect(ctx context.Context, rc kafka.ReaderConfig, start int64, dial func(context.Context, string) (Conn, error)) (Reader, error) {
+	var (
+		conn Conn
+		err  error
+	)
+	for _, b := range rc.Brokers {
+		conn, err = dial(ctx, b)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("in rpc.connect cannot dial any of %v: %w", rc.Brokers, err)
+	}
+	defer conn.Close()
+
+	partitions, err := conn.ReadPartitions(rc.Topic)
+	if err != nil {
+		return nil, fmt.Errorf("in rpc.connect cannot read partitions of %q: %w", rc.Topic, err)
+	}
+	if len(partitions) == 0 {
+		return nil, fmt.Errorf("in rpc.connect topic %q is not created yet", rc.Topic)
+	}
+	if len(rc.GroupID) > 0 {
+		return kafka.NewReader(rc), nil
+	}
+	for _, p := range partitions {
+		if p.ID != rc.Partition {
+			continue
+		}
+		// reader without consumer group ignores start offset of rc
+		rd := kafka.NewReader(rc)
+		err = rd.SetOffset(start)
+		if err != nil {
+			rd.Close()
+			return nil, fmt.Errorf("in rpc.connect cannot set offset of partition %d of %q to %d: %v", rc.Partition, rc.Topic, start, err)
+		}
+		return rd, nil
+	}
+	return nil, fmt.Errorf("in rpc.connect partition %d of %q is not created yet", rc.Partition, rc.Topic)
+}
+
+// drop closes reader, so that it is rebuilt by supervise
+func (r *ReceiverStruct) drop() {
+	metrics.Ready.Set(0)
+
+	if r.R == nil {
+		return
+	}
+	if err := r.R.Close(); err != nil {
+		logger.L.Errorf("in rpc.drop cannot close reader: %v\n", err)
+	}
+	r.R = nil
+}
@@ -0,0 +1,372 @@
+// Helper package for reading configuration from environment and optional config file
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	PolicyMove   = "move"   // abandoned submissions are moved aside
+	PolicyDelete = "delete" // abandoned submissions are deleted
+)
+
+const (
+	FsyncNone     = "none"     // nothing is flushed to disk explicitly
+	FsyncClose    = "close"    // files are flushed when closed, folders when submission is published
+	FsyncChunk    = "chunk"    // every chunk, journal record and new folder entry is flushed at once
+	FsyncPeriodic = "periodic" // as close, with open files flushed every fsync interval as well
+)
+
+const (
+	StorageLocal = "local" // submissions are published under results path
+	// Files are streamed to S3-compatible bucket, results path keeps manifests and journals of unfinished submissions.
+	// Streamed data is buffered in memory, so submissions left unfinished by restart are abandoned
+	StorageS3 = "s3"
+)
+
+const (
+	OffsetFirst = "first" // partition without committed offset is read from its oldest message
+	OffsetLast  = "last"  // partition without committed offset is read from messages produced after start
+)
+
+const (
+	IsolationUncommitted = "read_uncommitted" // messages of aborted transactions are read as well
+	IsolationCommitted   = "read_committed"   // only messages of committed transactions are read
+)
+
+type Config struct {
+	LogLevel           log.Level
+	ResultsPath        string        // root folder of saved submissions, read at startup only
+	SessionTimeout     time.Duration // inactivity period after which submission is abandoned, zero disables it
+	AbandonPolicy      string        // what to do with abandoned submissions
+	AbandonedRetention time.Duration // how long moved submissions and ts of given up ones are kept, zero keeps them forever
+	ShutdownTimeout    time.Duration // how long Stop may drain before giving up
+	TextInlineLimit    int64         // text values longer than this many bytes are saved to files, read at startup only
+	Fsync              string        // durability policy, read at startup only
+	FsyncInterval      time.Duration // how often open files are flushed under periodic policy, read at startup only
+	MetricsAddr        string        // address metrics are served on, empty disables them, read at startup only
+	MaxOpenFiles       int           // how many files are kept open at most, zero means unlimited, read at startup only
+	Storage            string        // where submissions are published, read at startup only
+	S3Endpoint         string        // URL of S3-compatible storage, e.g. http://minio:9000
+	S3Region           string        // region requests are signed for
+	S3Bucket           string        // bucket addressed in path style
+	S3Prefix           string        // prepended to object keys, e.g. "submissions/"
+	S3AccessKey        string        // access key id requests are signed with
+	S3SecretKey        string        // secret access key requests are signed with
+	S3PartSize         int64         // how much of file is buffered in memory before it is sent as part of multipart upload
+	DeadLetterTopic    string        // topic undecodable and unsaveable messages are published to, empty disables it, read at startup only
+	SaveAttempts       int           // how many times message failing transiently is tried before it is given up, read at startup only
+	RetryBackoff       time.Duration // delay before second attempt, doubled for each next one, read at startup only
+	RetryBackoffMax    time.Duration // delay between attempts never exceeds it, read at startup only
+	ConnectTimeout     time.Duration // how long kafka may stay unreachable before application fails, zero waits forever, read at startup only
+	ReconnectBackoff   time.Duration // delay before second attempt to connect to kafka, doubled for each next one, read at startup only
+	ReconnectMax       time.Duration // delay between attempts to connect never exceeds it, read at startup only
+	// kafka consumer settings, read at startup only
+	KafkaBrokers           []string      // host:port of bootstrap brokers
+	KafkaTopic             string        // topic submissions are read from
+	KafkaGroupID           string        // consumer group, empty if partition is read on its own
+	KafkaPartition         int           // partition read without consumer group, -1 if consumer group is used
+	KafkaMinBytes          int           // fetch waits for at least this many bytes
+	KafkaMaxBytes          int           // fetch returns at most this many bytes
+	KafkaMaxWait           time.Duration // fetch waits for min bytes at most this long
+	KafkaStartOffset       string        // where partition without committed or saved offset is read from
+	KafkaSessionTimeout    time.Duration // consumer missing heartbeats this long is dropped from group
+	KafkaHeartbeatInterval time.Duration // how often consumer sends heartbeats to group
+	KafkaIsolationLevel    string        // whether messages of aborted transactions are read
+}
+
+// Load reads configuration from environment, using defaults for unset variables.
+// Variables may be set in file named by SAVER_CONFIG_FILE as well, environment takes precedence over it
+func Load() (*Config, error) {
+	var err error
+
+	v, err := readFile(os.Getenv("SAVER_CONFIG_FILE"))
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{}
+
+	c.LogLevel, err = log.ParseLevel(v.getString("SAVER_LOG_LEVEL", "info"))
+	if err != nil {
+		return nil, fmt.Errorf("in config.Load unable to parse SAVER_LOG_LEVEL: %v", err)
+	}
+	c.ResultsPath = v.getString("SAVER_RESULTS_PATH", "results")
+
+	c.SessionTimeout, err = v.getDuration("SAVER_SESSION_TIMEOUT", 5*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	c.AbandonPolicy = v.getString("SAVER_ABANDON_POLICY", PolicyMove)
+	if c.AbandonPolicy != PolicyMove && c.AbandonPolicy != PolicyDelete {
+		return nil, fmt.Errorf("in config.Load SAVER_ABANDON_POLICY must be %q or %q, got %q", PolicyMove, PolicyDelete, c.AbandonPolicy)
+	}
+	c.AbandonedRetention, err = v.getDuration("SAVER_ABANDONED_RETENTION", 24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	c.ShutdownTimeout, err = v.getDuration("SAVER_SHUTDOWN_TIMEOUT", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c.TextInlineLimit, err = v.getSize("SAVER_TEXT_INLINE_LIMIT", 64<<10)
+	if err != nil {
+		return nil, err
+	}
+	c.Fsync = v.getString("SAVER_FSYNC", FsyncChunk)
+	switch c.Fsync {
+	case FsyncNone, FsyncClose, FsyncChunk, FsyncPeriodic:
+	default:
+		return nil, fmt.Errorf("in config.Load SAVER_FSYNC must be one of %q, %q, %q, %q, got %q", FsyncNone, FsyncClose, FsyncChunk, FsyncPeriodic, c.Fsync)
+	}
+	c.FsyncInterval, err = v.getDuration("SAVER_FSYNC_INTERVAL", time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if c.Fsync == FsyncPeriodic && c.FsyncInterval == 0 {
+		return nil, fmt.Errorf("in config.Load SAVER_FSYNC_INTERVAL must be positive for %q policy", FsyncPeriodic)
+	}
+	c.MetricsAddr = v.getString("SAVER_METRICS_ADDR", "")
+
+	maxOpenFiles, err := v.getSize("SAVER_MAX_OPEN_FILES", 1024)
+	if err != nil {
+		return nil, err
+	}
+	c.MaxOpenFiles = int(maxOpenFiles)
+
+	c.Storage = v.getString("SAVER_STORAGE", StorageLocal)
+	if c.Storage != StorageLocal && c.Storage != StorageS3 {
+		return nil, fmt.Errorf("in config.Load SAVER_STORAGE must be %q or %q, got %q", StorageLocal, StorageS3, c.Storage)
+	}
+	c.S3Endpoint = v.getString("SAVER_S3_ENDPOINT", "")
+	c.S3Region = v.getString("SAVER_S3_REGION", "us-east-1")
+	c.S3Bucket = v.getString("SAVER_S3_BUCKET", "")
+	c.S3Prefix = v.getString("SAVER_S3_PREFIX", "")
+	c.S3AccessKey = v.getString("SAVER_S3_ACCESS_KEY", "")
+	c.S3SecretKey = v.getString("SAVER_S3_SECRET_KEY", "")
+	c.S3PartSize, err = v.getSize("SAVER_S3_PART_SIZE", 5<<20)
+	if err != nil {
+		return nil, err
+	}
+	if c.S3PartSize < 5<<20 {
+		return nil, fmt.Errorf("in config.Load SAVER_S3_PART_SIZE must be at least 5 MiB, got %d", c.S3PartSize)
+	}
+	if c.Storage == StorageS3 && (len(c.S3Endpoint) == 0 || len(c.S3Bucket) == 0) {
+		return nil, fmt.Errorf("in config.Load SAVER_S3_ENDPOINT and SAVER_S3_BUCKET must be set for %q storage", StorageS3)
+	}
+
+	c.DeadLetterTopic = v.getString("KAFKA_DLQ_TOPIC", "")
+
+	saveAttempts, err := v.getSize("SAVER_SAVE_ATTEMPTS", 5)
+	if err != nil {
+		return nil, err
+	}
+	if saveAttempts == 0 {
+		return nil, fmt.Errorf("in config.Load SAVER_SAVE_ATTEMPTS must be positive")
+	}
+	c.SaveAttempts = int(saveAttempts)
+
+	c.RetryBackoff, err = v.getDuration("SAVER_RETRY_BACKOFF", time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c.RetryBackoffMax, err = v.getDuration("SAVER_RETRY_BACKOFF_MAX", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if c.RetryBackoffMax < c.RetryBackoff {
+		return nil, fmt.Errorf("in config.Load SAVER_RETRY_BACKOFF_MAX cannot be less than SAVER_RETRY_BACKOFF")
+	}
+
+	c.ConnectTimeout, err = v.getDuration("KAFKA_CONNECT_TIMEOUT", 0)
+	if err != nil {
+		return nil, err
+	}
+	c.ReconnectBackoff, err = v.getDuration("KAFKA_RECONNECT_BACKOFF", time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c.ReconnectMax, err = v.getDuration("KAFKA_RECONNECT_BACKOFF_MAX", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if c.ReconnectMax < c.ReconnectBackoff {
+		return nil, fmt.Errorf("in config.Load KAFKA_RECONNECT_BACKOFF_MAX cannot be less than KAFKA_RECONNECT_BACKOFF")
+	}
+
+	err = v.loadKafka(c)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// loadKafka reads consumer settings. Brokers are listed in KAFKA_BROKERS or given by KAFKA_ADDR and KAFKA_PORT.
+// Explicit partition excludes consumer group
+func (v values) loadKafka(c *Config) error {
+	var err error
+
+	brokers := v.getString("KAFKA_BROKERS", "")
+	if len(brokers) == 0 {
+		brokers = net.JoinHostPort(v.getString("KAFKA_ADDR", "localhost"), v.getString("KAFKA_PORT", "9092"))
+	}
+	for _, b := range strings.Split(brokers, ",") {
+		b = strings.TrimSpace(b)
+		host, port, err := net.SplitHostPort(b)
+		if err != nil || len(host) == 0 || len(port) == 0 {
+			return fmt.Errorf("in config.loadKafka broker %q must be host:port", b)
+		}
+		c.KafkaBrokers = append(c.KafkaBrokers, b)
+	}
+	c.KafkaTopic = v.getString("KAFKA_TOPIC", "")
+	if len(c.KafkaTopic) == 0 {
+		return fmt.Errorf("in config.loadKafka KAFKA_TOPIC must be set")
+	}
+
+	partition, err := v.getSize("KAFKA_PARTITION", -1)
+	if err != nil {
+		return err
+	}
+	c.KafkaPartition = int(partition)
+	_, groupSet := v.lookup("KAFKA_CONSUMER_GROUP_ID")
+	switch {
+	case c.KafkaPartition >= 0 && groupSet:
+		return fmt.Errorf("in config.loadKafka KAFKA_PARTITION and KAFKA_CONSUMER_GROUP_ID cannot be set both")
+	case c.KafkaPartition < 0:
+		c.KafkaGroupID = v.getString("KAFKA_CONSUMER_GROUP_ID", "0")
+	}
+
+	minBytes, err := v.getSize("KAFKA_MIN_BYTES", 1)
+	if err != nil {
+		return err
+	}
+	maxBytes, err := v.getSize("KAFKA_MAX_BYTES", 1e6)
+	if err != nil {
+		return err
+	}
+	if minBytes == 0 || maxBytes < minBytes || maxBytes > 1<<31-1 {
+		return fmt.Errorf("in config.loadKafka KAFKA_MIN_BYTES must be positive and not greater than KAFKA_MAX_BYTES, got %d and %d", minBytes, maxBytes)
+	}
+	c.KafkaMinBytes, c.KafkaMaxBytes = int(minBytes), int(maxBytes)
+
+	c.KafkaMaxWait, err = v.getDuration("KAFKA_MAX_WAIT", 10*time.Second)
+	if err != nil {
+		return err
+	}
+	if c.KafkaMaxWait < time.Millisecond {
+		return fmt.Errorf("in config.loadKafka KAFKA_MAX_WAIT must be at least 1ms, got %v", c.KafkaMaxWait)
+	}
+	c.KafkaStartOffset = v.getString("KAFKA_START_OFFSET", OffsetFirst)
+	if c.KafkaStartOffset != OffsetFirst && c.KafkaStartOffset != OffsetLast {
+		return fmt.Errorf("in config.loadKafka KAFKA_START_OFFSET must be %q or %q, got %q", OffsetFirst, OffsetLast, c.KafkaStartOffset)
+	}
+	c.KafkaSessionTimeout, err = v.getDuration("KAFKA_SESSION_TIMEOUT", 30*time.Second)
+	if err != nil {
+		return err
+	}
+	c.KafkaHeartbeatInterval, err = v.getDuration("KAFKA_HEARTBEAT_INTERVAL", 3*time.Second)
+	if err != nil {
+		return err
+	}
+	if c.KafkaHeartbeatInterval == 0 || c.KafkaHeartbeatInterval >= c.KafkaSessionTimeout {
+		return fmt.Errorf("in config.loadKafka KAFKA_HEARTBEAT_INTERVAL must be positive and less than KAFKA_SESSION_TIMEOUT")
+	}
+	c.KafkaIsolationLevel = v.getString("KAFKA_ISOLATION_LEVEL", IsolationUncommitted)
+	if c.KafkaIsolationLevel != IsolationUncommitted && c.KafkaIsolationLevel != IsolationCommitted {
+		return fmt.Errorf("in config.loadKafka KAFKA_ISOLATION_LEVEL must be %q or %q, got %q", IsolationUncommitted, IsolationCommitted, c.KafkaIsolationLevel)
+	}
+	return nil
+}
+
+// values holds variables set in config file
+type values map[string]string
+
+// readFile reads variables from file fileName, one NAME=value per line.
+// Empty lines and lines starting with # are skipped, value may be quoted. No file gives no variables
+func readFile(fileName string) (values, error) {
+	v := make(values)
+	if len(fileName) == 0 {
+		return v, nil
+	}
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("in config.readFile unable to open config file %q: %v", fileName, err)
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !ok || len(name) == 0 {
+			return nil, fmt.Errorf("in config.readFile line %d of %q is not NAME=value", n, fileName)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) > 1 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		v[name] = value
+	}
+	if err = sc.Err(); err != nil {
+		return nil, fmt.Errorf("in config.readFile unable to read config file %q: %v", fileName, err)
+	}
+	return v, nil
+}
+
+// lookup returns variable name set in environment or, failing that, in config file
+func (v values) lookup(name string) (string, bool) {
+	if s, ok := os.LookupEnv(name); ok && len(s) > 0 {
+		return s, true
+	}
+	s, ok := v[name]
+	return s, ok && len(s) > 0
+}
+
+func (v values) getString(name, def string) string {
+	if s, ok := v.lookup(name); ok {
+		return s
+	}
+	return def
+}
+
+func (v values) getDuration(name string, def time.Duration) (time.Duration, error) {
+	s, ok := v.lookup(name)
+	if !ok {
+		return def, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("in config.getDuration unable to parse %s: %v", name, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("in config.getDuration %s cannot be negative, got %q", name, s)
+	}
+	return d, nil
+}
+
+// getSize reads non-negative size in bytes
+func (v values) getSize(name string, def int64) (int64, error) {
+	s, ok := v.lookup(name)
+	if !ok {
+		return def, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("in config.getSize unable to parse %s: %v", name, err)
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("in config.getSize %s cannot be negative, got %q", name, s)
+	}
+	return n, nil
+}
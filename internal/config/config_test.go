@@ -0,0 +1,374 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+type configSuite struct {
+	suite.Suite
+}
+
+func TestConfigSuite(t *testing.T) {
+	suite.Run(t, new(configSuite))
+}
+
+func (s *configSuite) TestLoad() {
+	tt := []struct {
+		name    string
+		env     map[string]string
+		file    string // content of config file, none if empty
+		want    *Config
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			env:  map[string]string{"KAFKA_TOPIC": "topic1"},
+			want: &Config{
+				LogLevel:               log.InfoLevel,
+				ResultsPath:            "results",
+				SessionTimeout:         5 * time.Minute,
+				AbandonPolicy:          PolicyMove,
+				AbandonedRetention:     24 * time.Hour,
+				ShutdownTimeout:        30 * time.Second,
+				TextInlineLimit:        64 << 10,
+				Fsync:                  FsyncChunk,
+				FsyncInterval:          time.Second,
+				MaxOpenFiles:           1024,
+				Storage:                StorageLocal,
+				S3Region:               "us-east-1",
+				S3PartSize:             5 << 20,
+				SaveAttempts:           5,
+				RetryBackoff:           time.Second,
+				RetryBackoffMax:        30 * time.Second,
+				ReconnectBackoff:       time.Second,
+				ReconnectMax:           30 * time.Second,
+				KafkaBrokers:           []string{"localhost:9092"},
+				KafkaTopic:             "topic1",
+				KafkaGroupID:           "0",
+				KafkaPartition:         -1,
+				KafkaMinBytes:          1,
+				KafkaMaxBytes:          1e6,
+				KafkaMaxWait:           10 * time.Second,
+				KafkaStartOffset:       OffsetFirst,
+				KafkaSessionTimeout:    30 * time.Second,
+				KafkaHeartbeatInterval: 3 * time.Second,
+				KafkaIsolationLevel:    IsolationUncommitted,
+			},
+		},
+		{
+			name: "all set",
+			env: map[string]string{
+				"SAVER_LOG_LEVEL":             "debug",
+				"SAVER_RESULTS_PATH":          "/results",
+				"SAVER_SESSION_TIMEOUT":       "30s",
+				"SAVER_ABANDON_POLICY":        "delete",
+				"SAVER_ABANDONED_RETENTION":   "0",
+				"SAVER_SHUTDOWN_TIMEOUT":      "1m",
+				"SAVER_TEXT_INLINE_LIMIT":     "0",
+				"SAVER_FSYNC":                 "periodic",
+				"SAVER_FSYNC_INTERVAL":        "100ms",
+				"SAVER_METRICS_ADDR":          ":9090",
+				"SAVER_MAX_OPEN_FILES":        "0",
+				"SAVER_STORAGE":               "s3",
+				"SAVER_S3_ENDPOINT":           "http://minio:9000",
+				"SAVER_S3_REGION":             "eu-west-1",
+				"SAVER_S3_BUCKET":             "submissions",
+				"SAVER_S3_PREFIX":             "saver/",
+				"SAVER_S3_ACCESS_KEY":         "access",
+				"SAVER_S3_SECRET_KEY":         "secret",
+				"SAVER_S3_PART_SIZE":          "8388608",
+				"KAFKA_DLQ_TOPIC":             "dlq",
+				"SAVER_SAVE_ATTEMPTS":         "1",
+				"SAVER_RETRY_BACKOFF":         "0",
+				"SAVER_RETRY_BACKOFF_MAX":     "0",
+				"KAFKA_CONNECT_TIMEOUT":       "5m",
+				"KAFKA_RECONNECT_BACKOFF":     "100ms",
+				"KAFKA_RECONNECT_BACKOFF_MAX": "10s",
+				"KAFKA_BROKERS":               "kafka1:9092, kafka2:9093",
+				"KAFKA_TOPIC":                 "data",
+				"KAFKA_PARTITION":             "0",
+				"KAFKA_MIN_BYTES":             "10",
+				"KAFKA_MAX_BYTES":             "2000000",
+				"KAFKA_MAX_WAIT":              "500ms",
+				"KAFKA_START_OFFSET":          "last",
+				"KAFKA_SESSION_TIMEOUT":       "10s",
+				"KAFKA_HEARTBEAT_INTERVAL":    "1s",
+				"KAFKA_ISOLATION_LEVEL":       "read_committed",
+			},
+			want: &Config{
+				LogLevel:               log.DebugLevel,
+				ResultsPath:            "/results",
+				SessionTimeout:         30 * time.Second,
+				AbandonPolicy:          PolicyDelete,
+				AbandonedRetention:     0,
+				ShutdownTimeout:        time.Minute,
+				TextInlineLimit:        0,
+				Fsync:                  FsyncPeriodic,
+				FsyncInterval:          100 * time.Millisecond,
+				MetricsAddr:            ":9090",
+				MaxOpenFiles:           0,
+				Storage:                StorageS3,
+				S3Endpoint:             "http://minio:9000",
+				S3Region:               "eu-west-1",
+				S3Bucket:               "submissions",
+				S3Prefix:               "saver/",
+				S3AccessKey:            "access",
+				S3SecretKey:            "secret",
+				S3PartSize:             8 << 20,
+				DeadLetterTopic:        "dlq",
+				SaveAttempts:           1,
+				RetryBackoff:           0,
+				RetryBackoffMax:        0,
+				ConnectTimeout:         5 * time.Minute,
+				ReconnectBackoff:       100 * time.Millisecond,
+				ReconnectMax:           10 * time.Second,
+				KafkaBrokers:           []string{"kafka1:9092", "kafka2:9093"},
+				KafkaTopic:             "data",
+				KafkaPartition:         0,
+				KafkaMinBytes:          10,
+				KafkaMaxBytes:          2e6,
+				KafkaMaxWait:           500 * time.Millisecond,
+				KafkaStartOffset:       OffsetLast,
+				KafkaSessionTimeout:    10 * time.Second,
+				KafkaHeartbeatInterval: time.Second,
+				KafkaIsolationLevel:    IsolationCommitted,
+			},
+		},
+		{
+			name: "config file",
+			env: map[string]string{
+				"KAFKA_PORT":              "29092",
+				"KAFKA_CONSUMER_GROUP_ID": "savers",
+			},
+			file: `
+# kafka
+KAFKA_ADDR = kafka
+KAFKA_PORT=9092
+KAFKA_TOPIC="topic1"
+KAFKA_CONSUMER_GROUP_ID=
+SAVER_RESULTS_PATH='/results'
+`,
+			want: &Config{
+				LogLevel:               log.InfoLevel,
+				ResultsPath:            "/results",
+				SessionTimeout:         5 * time.Minute,
+				AbandonPolicy:          PolicyMove,
+				AbandonedRetention:     24 * time.Hour,
+				ShutdownTimeout:        30 * time.Second,
+				TextInlineLimit:        64 << 10,
+				Fsync:                  FsyncChunk,
+				FsyncInterval:          time.Second,
+				MaxOpenFiles:           1024,
+				Storage:                StorageLocal,
+				S3Region:               "us-east-1",
+				S3PartSize:             5 << 20,
+				SaveAttempts:           5,
+				RetryBackoff:           time.Second,
+				RetryBackoffMax:        30 * time.Second,
+				ReconnectBackoff:       time.Second,
+				ReconnectMax:           30 * time.Second,
+				KafkaBrokers:           []string{"kafka:29092"},
+				KafkaTopic:             "topic1",
+				KafkaGroupID:           "savers",
+				KafkaPartition:         -1,
+				KafkaMinBytes:          1,
+				KafkaMaxBytes:          1e6,
+				KafkaMaxWait:           10 * time.Second,
+				KafkaStartOffset:       OffsetFirst,
+				KafkaSessionTimeout:    30 * time.Second,
+				KafkaHeartbeatInterval: 3 * time.Second,
+				KafkaIsolationLevel:    IsolationUncommitted,
+			},
+		},
+		{
+			name:    "malformed config file",
+			env:     map[string]string{"KAFKA_TOPIC": "topic1"},
+			file:    "KAFKA_ADDR kafka\n",
+			wantErr: true,
+		},
+		{
+			name:    "no topic",
+			env:     map[string]string{},
+			wantErr: true,
+		},
+		{
+			name: "malformed broker",
+			env: map[string]string{
+				"KAFKA_TOPIC":   "topic1",
+				"KAFKA_BROKERS": "kafka1:9092,kafka2",
+			},
+			wantErr: true,
+		},
+		{
+			name: "partition and group",
+			env: map[string]string{
+				"KAFKA_TOPIC":             "topic1",
+				"KAFKA_PARTITION":         "0",
+				"KAFKA_CONSUMER_GROUP_ID": "0",
+			},
+			wantErr: true,
+		},
+		{
+			name: "min bytes exceed max bytes",
+			env: map[string]string{
+				"KAFKA_TOPIC":     "topic1",
+				"KAFKA_MIN_BYTES": "2000000",
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown start offset",
+			env: map[string]string{
+				"KAFKA_TOPIC":        "topic1",
+				"KAFKA_START_OFFSET": "middle",
+			},
+			wantErr: true,
+		},
+		{
+			name: "heartbeat exceeds session",
+			env: map[string]string{
+				"KAFKA_TOPIC":              "topic1",
+				"KAFKA_HEARTBEAT_INTERVAL": "1m",
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown isolation level",
+			env: map[string]string{
+				"KAFKA_TOPIC":           "topic1",
+				"KAFKA_ISOLATION_LEVEL": "serializable",
+			},
+			wantErr: true,
+		},
+		{
+			name: "malformed timeout",
+			env: map[string]string{
+				"SAVER_SESSION_TIMEOUT": "soon",
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative timeout",
+			env: map[string]string{
+				"SAVER_SESSION_TIMEOUT": "-1s",
+			},
+			wantErr: true,
+		},
+		{
+			name: "malformed size",
+			env: map[string]string{
+				"SAVER_TEXT_INLINE_LIMIT": "64KiB",
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative size",
+			env: map[string]string{
+				"SAVER_TEXT_INLINE_LIMIT": "-1",
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown fsync policy",
+			env: map[string]string{
+				"SAVER_FSYNC": "always",
+			},
+			wantErr: true,
+		},
+		{
+			name: "periodic without interval",
+			env: map[string]string{
+				"SAVER_FSYNC":          "periodic",
+				"SAVER_FSYNC_INTERVAL": "0",
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown storage",
+			env: map[string]string{
+				"SAVER_STORAGE": "ftp",
+			},
+			wantErr: true,
+		},
+		{
+			name: "s3 without bucket",
+			env: map[string]string{
+				"SAVER_STORAGE":     "s3",
+				"SAVER_S3_ENDPOINT": "http://minio:9000",
+			},
+			wantErr: true,
+		},
+		{
+			name: "small part size",
+			env: map[string]string{
+				"SAVER_S3_PART_SIZE": "1048576",
+			},
+			wantErr: true,
+		},
+		{
+			name: "no save attempts",
+			env: map[string]string{
+				"SAVER_SAVE_ATTEMPTS": "0",
+			},
+			wantErr: true,
+		},
+		{
+			name: "backoff exceeds its limit",
+			env: map[string]string{
+				"SAVER_RETRY_BACKOFF":     "1m",
+				"SAVER_RETRY_BACKOFF_MAX": "30s",
+			},
+			wantErr: true,
+		},
+		{
+			name: "reconnect backoff exceeds its limit",
+			env: map[string]string{
+				"KAFKA_RECONNECT_BACKOFF": "1m",
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown log level",
+			env: map[string]string{
+				"SAVER_LOG_LEVEL": "loud",
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown policy",
+			env: map[string]string{
+				"SAVER_ABANDON_POLICY": "keep",
+			},
+			wantErr: true,
+		},
+	}
+	for _, v := range tt {
+		s.Run(v.name, func() {
+			for _, k := range []string{"SAVER_LOG_LEVEL", "SAVER_RESULTS_PATH", "SAVER_SESSION_TIMEOUT", "SAVER_ABANDON_POLICY", "SAVER_ABANDONED_RETENTION", "SAVER_SHUTDOWN_TIMEOUT", "SAVER_TEXT_INLINE_LIMIT", "SAVER_FSYNC", "SAVER_FSYNC_INTERVAL", "SAVER_METRICS_ADDR", "SAVER_MAX_OPEN_FILES", "SAVER_STORAGE", "SAVER_S3_ENDPOINT", "SAVER_S3_REGION", "SAVER_S3_BUCKET", "SAVER_S3_PREFIX", "SAVER_S3_ACCESS_KEY", "SAVER_S3_SECRET_KEY", "SAVER_S3_PART_SIZE", "KAFKA_DLQ_TOPIC", "SAVER_SAVE_ATTEMPTS", "SAVER_RETRY_BACKOFF", "SAVER_RETRY_BACKOFF_MAX", "KAFKA_CONNECT_TIMEOUT", "KAFKA_RECONNECT_BACKOFF", "KAFKA_RECONNECT_BACKOFF_MAX",
+				"KAFKA_BROKERS", "KAFKA_ADDR", "KAFKA_PORT", "KAFKA_TOPIC", "KAFKA_CONSUMER_GROUP_ID", "KAFKA_PARTITION", "KAFKA_MIN_BYTES", "KAFKA_MAX_BYTES", "KAFKA_MAX_WAIT", "KAFKA_START_OFFSET", "KAFKA_SESSION_TIMEOUT", "KAFKA_HEARTBEAT_INTERVAL", "KAFKA_ISOLATION_LEVEL"} {
+				s.T().Setenv(k, v.env[k])
+			}
+			fileName := ""
+			if len(v.file) > 0 {
+				fileName = filepath.Join(s.T().TempDir(), "saver.env")
+				s.Require().NoError(os.WriteFile(fileName, []byte(v.file), 0666))
+			}
+			s.T().Setenv("SAVER_CONFIG_FILE", fileName)
+
+			got, err := Load()
+
+			if v.wantErr {
+				s.Error(err)
+				return
+			}
+			s.NoError(err)
+			s.Equal(v.want, got)
+		})
+	}
+}
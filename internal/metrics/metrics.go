@@ -0,0 +1,50 @@
+// Helper package for exposing metrics.
+// Metrics are published by expvar and served as JSON at /debug/vars, readiness is served at /ready
+package metrics
+
+import (
+	"expvar"
+	"net/http"
+	"time"
+)
+
+var (
+	FsyncPolicy  = expvar.NewString("saver_fsync_policy")
+	Fsyncs       = expvar.NewInt("saver_fsyncs")
+	FsyncSeconds = expvar.NewFloat("saver_fsync_seconds")
+	Chunks       = expvar.NewInt("saver_chunks_saved")
+	Bytes        = expvar.NewInt("saver_bytes_saved")
+
+	OpenFiles       = expvar.NewInt("saver_open_files")
+	HandleReopens   = expvar.NewInt("saver_handle_reopens")
+	HandleEvictions = expvar.NewInt("saver_handle_evictions")
+
+	Retries     = expvar.NewInt("receiver_retries")
+	DeadLetters = expvar.NewInt("receiver_dead_letters")
+	Ready       = expvar.NewInt("receiver_ready")      // 1 while receiver is connected to kafka
+	Reconnects  = expvar.NewInt("receiver_reconnects") // readers rebuilt after failures
+)
+
+// Fsync accounts single flush to disk which took time since start
+func Fsync(start time.Time) {
+	Fsyncs.Add(1)
+	FsyncSeconds.Add(time.Since(start).Seconds())
+}
+
+// Serve serves metrics on addr until it fails
+func Serve(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/ready", serveReady)
+
+	return http.ListenAndServe(addr, mux)
+}
+
+// serveReady responds with 200 while receiver is connected and with 503 otherwise
+func serveReady(w http.ResponseWriter, r *http.Request) {
+	if Ready.Value() != 1 {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ready"))
+}
@@ -0,0 +1,31 @@
+package repo
+
+import "errors"
+
+// PermanentError is error which happens again however many times operation is tried, e.g. invalid or conflicting data.
+// Errors not marked so are transient, e.g. full disk or unavailable storage
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// Permanent marks err as permanent, nil stays nil
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// IsPermanent tells whether err or any error it wraps is permanent
+func IsPermanent(err error) bool {
+	var pe *PermanentError
+	return errors.As(err, &pe)
+}
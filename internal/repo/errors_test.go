@@ -0,0 +1,31 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+)
+
+func (s *repoSuite) TestIsPermanent() {
+	conflict := errors.New("already exists")
+
+	tt := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: Permanent(nil)},
+		{name: "plain", err: conflict},
+		{name: "permanent", err: Permanent(conflict), want: true},
+		{name: "wrapped", err: fmt.Errorf("in repo.Test unable to save: %w", Permanent(conflict)), want: true},
+		{name: "formatted", err: fmt.Errorf("in repo.Test unable to save: %v", Permanent(conflict))},
+	}
+	for _, v := range tt {
+		s.Run(v.name, func() {
+			s.Equal(v.want, IsPermanent(v.err))
+			if v.want {
+				s.ErrorIs(v.err, conflict)
+				s.Equal("already exists", Permanent(conflict).Error())
+			}
+		})
+	}
+}
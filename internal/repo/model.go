@@ -4,16 +4,24 @@ package repo
 import "os"
 
 type FileInfo struct {
-	F *os.File // file pointer
-	O int64    // offset
+	F    *os.File // file pointer, nil while file is closed
+	O    int64    // offset
+	Path string   // file name to reopen closed file with
 }
 
 func NewFileInfo(f *os.File, o int64) *FileInfo {
 	return &FileInfo{
-		F: f,
-		O: o,
+		F:    f,
+		O:    o,
+		Path: f.Name(),
 	}
 }
 func (f *FileInfo) AddOffset(o int64) {
 	f.O += o
 }
+
+// Position locates message in kafka topic
+type Position struct {
+	Partition int
+	Offset    int64
+}
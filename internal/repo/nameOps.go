@@ -0,0 +1,107 @@
+package repo
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// MaxNameLen is the longest file name most filesystems accept, in bytes
+const MaxNameLen = 255
+
+// reservedNames are device names that cannot be used as file names on Windows, whatever the extension
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// CheckTS returns error if ts cannot be safely used as a folder name.
+// Ts identifies submission, so it is rejected rather than altered
+func CheckTS(ts string) error {
+	switch {
+	case len(ts) == 0:
+		return fmt.Errorf("in repo.CheckTS ts is empty")
+	case len(ts) > MaxNameLen:
+		return fmt.Errorf("in repo.CheckTS ts is longer than %d bytes", MaxNameLen)
+	case !utf8.ValidString(ts):
+		return fmt.Errorf("in repo.CheckTS ts %q is not valid UTF-8", ts)
+	case strings.HasPrefix(ts, "."):
+		return fmt.Errorf("in repo.CheckTS ts %q starts with dot", ts)
+	case strings.ContainsAny(ts, `/\:`):
+		return fmt.Errorf("in repo.CheckTS ts %q contains path separator", ts)
+	case strings.IndexFunc(ts, isUnsafeRune) >= 0:
+		return fmt.Errorf("in repo.CheckTS ts %q contains control characters", ts)
+	}
+	return nil
+}
+
+// SanitizeFileName turns file name sent by client into a safe name of a file inside submission folder.
+// Directory part is dropped, name is normalized to NFC, control and reserved characters are replaced,
+// leading dots and trailing dots and spaces are trimmed, reserved device names are prefixed
+// and name is shortened to MaxNameLen bytes keeping its extension
+func SanitizeFileName(name string) string {
+	name = strings.ToValidUTF8(name, "_")
+	name = strings.ReplaceAll(name, `\`, "/")
+	name = name[strings.LastIndex(name, "/")+1:]
+	name = norm.NFC.String(name)
+
+	name = strings.Map(func(r rune) rune {
+		if isUnsafeRune(r) {
+			return -1
+		}
+		if strings.ContainsRune(`<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+
+	name = strings.TrimLeft(name, ". ")
+	name = strings.TrimRight(name, ". ")
+
+	if len(name) == 0 {
+		return "file"
+	}
+	stem, ext := SplitExt(name)
+
+	if reservedNames[strings.ToUpper(strings.TrimRight(stem, " "))] {
+		stem = "_" + stem
+	}
+	return truncate(stem, ext)
+}
+
+// SplitExt splits name into stem and extension with leading dot
+func SplitExt(name string) (string, string) {
+	i := strings.LastIndex(name, ".")
+	if i <= 0 {
+		return name, ""
+	}
+	return name[:i], name[i:]
+}
+
+// truncate shortens stem so that stem with ext fit MaxNameLen bytes, not breaking runes
+func truncate(stem, ext string) string {
+	if len(ext) > MaxNameLen/2 {
+		ext = ""
+	}
+	for len(stem)+len(ext) > MaxNameLen {
+		_, size := utf8.DecodeLastRuneInString(stem)
+		stem = stem[:len(stem)-size]
+	}
+	return stem + ext
+}
+
+// isUnsafeRune reports control and invisible formatting characters, such as bidirectional overrides
+func isUnsafeRune(r rune) bool {
+	return unicode.IsControl(r) || unicode.Is(unicode.Cf, r)
+}
+
+// NumberedName adds number n to name before its extension, keeping result within MaxNameLen bytes
+func NumberedName(name string, n int) string {
+	stem, ext := SplitExt(name)
+	return truncate(stem, "_"+strconv.Itoa(n)+ext)
+}
@@ -0,0 +1,75 @@
+package repo
+
+import (
+	"strings"
+)
+
+func (s *repoSuite) TestCheckTS() {
+	tt := []struct {
+		name    string
+		ts      string
+		wantErr bool
+	}{
+		{name: "generated", ts: "17.10.2026 10_11_12.345"},
+		{name: "digits", ts: "001"},
+		{name: "empty", ts: "", wantErr: true},
+		{name: "parent", ts: "..", wantErr: true},
+		{name: "hidden", ts: ".abandoned", wantErr: true},
+		{name: "slash", ts: "001/../../etc", wantErr: true},
+		{name: "backslash", ts: `001\002`, wantErr: true},
+		{name: "colon", ts: "C:001", wantErr: true},
+		{name: "control", ts: "001\x00", wantErr: true},
+		{name: "bidi override", ts: "001\u202e", wantErr: true},
+		{name: "invalid UTF-8", ts: "001\xff", wantErr: true},
+		{name: "too long", ts: strings.Repeat("1", MaxNameLen+1), wantErr: true},
+	}
+	for _, v := range tt {
+		s.Run(v.name, func() {
+			err := CheckTS(v.ts)
+			if v.wantErr {
+				s.Error(err)
+			} else {
+				s.NoError(err)
+			}
+		})
+	}
+}
+
+func (s *repoSuite) TestSanitizeFileName() {
+	tt := []struct {
+		name     string
+		fileName string
+		want     string
+	}{
+		{name: "plain", fileName: "first.txt", want: "first.txt"},
+		{name: "unicode", fileName: "отчёт.pdf", want: "отчёт.pdf"},
+		{name: "decomposed unicode", fileName: "e\u0301.txt", want: "\u00e9.txt"},
+		{name: "traversal", fileName: "../../etc/passwd", want: "passwd"},
+		{name: "windows path", fileName: `C:\Users\alice\first.txt`, want: "first.txt"},
+		{name: "only dots", fileName: "..", want: "file"},
+		{name: "empty", fileName: "", want: "file"},
+		{name: "trailing slash", fileName: "dir/", want: "file"},
+		{name: "hidden", fileName: ".bashrc", want: "bashrc"},
+		{name: "trailing dots and spaces", fileName: "first.txt. . ", want: "first.txt"},
+		{name: "control characters", fileName: "fir\x00st\n.txt", want: "first.txt"},
+		{name: "bidi override", fileName: "evil\u202etxt.exe", want: "eviltxt.exe"},
+		{name: "reserved characters", fileName: `a<b>c:d"e|f?g*.txt`, want: "a_b_c_d_e_f_g_.txt"},
+		{name: "invalid UTF-8", fileName: "fi\xffrst.txt", want: "fi_rst.txt"},
+		{name: "reserved device", fileName: "con.txt", want: "_con.txt"},
+		{name: "reserved device without extension", fileName: "LPT1", want: "_LPT1"},
+		{name: "not reserved", fileName: "console.txt", want: "console.txt"},
+		{name: "too long", fileName: strings.Repeat("a", 300) + ".txt", want: strings.Repeat("a", MaxNameLen-4) + ".txt"},
+		{name: "too long multibyte", fileName: strings.Repeat("ё", 200) + ".txt", want: strings.Repeat("ё", (MaxNameLen-4)/2) + ".txt"},
+	}
+	for _, v := range tt {
+		s.Run(v.name, func() {
+			s.Equal(v.want, SanitizeFileName(v.fileName))
+		})
+	}
+}
+
+func (s *repoSuite) TestNumberedName() {
+	s.Equal("first_1.txt", NumberedName("first.txt", 1))
+	s.Equal("first_12", NumberedName("first", 12))
+	s.Equal(strings.Repeat("a", MaxNameLen-6)+"_1.txt", NumberedName(strings.Repeat("a", MaxNameLen-4)+".txt", 1))
+}